@@ -0,0 +1,200 @@
+package main
+
+import (
+	"strings"
+)
+
+// capState tracks IRCv3 capability negotiation for a connection
+type capState struct {
+	available   map[string]string // Advertised by the server (name -> value)
+	enabled     map[string]bool   // Acknowledged by the server
+	lsBuffer    []string          // Accumulates multi-line CAP LS replies
+	pending     int               // Outstanding CAP REQs awaiting ACK/NAK
+	negotiating bool              // True until CAP END has been sent
+}
+
+func newCapState() capState {
+	return capState{
+		available: make(map[string]string),
+		enabled:   make(map[string]bool),
+	}
+}
+
+// HasCap returns whether a capability has been acknowledged by the server
+func (c *Conn) HasCap(name string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.caps.enabled[name]
+}
+
+// CapValue returns the value advertised by the server for a capability
+// (e.g. "PLAIN,EXTERNAL" for sasl) and whether it was advertised at all
+func (c *Conn) CapValue(name string) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	value, ok := c.caps.available[name]
+	return value, ok
+}
+
+// startCapNegotiation begins CAP negotiation; registration is held by the
+// server until CAP END is sent
+func (c *Conn) startCapNegotiation() {
+	c.mu.Lock()
+	c.caps = newCapState()
+	c.caps.negotiating = len(c.wantedCaps()) > 0
+	negotiating := c.caps.negotiating
+	c.mu.Unlock()
+
+	if negotiating {
+		c.sendRaw("CAP LS 302")
+	}
+}
+
+// handleCap processes CAP replies from the server
+// Format: CAP <nick> <subcommand> [*] :<caps>
+func (c *Conn) handleCap(line *Line) {
+	if len(line.Args) < 3 {
+		return
+	}
+
+	subcmd := strings.ToUpper(line.Args[1])
+	more := len(line.Args) >= 4 && line.Args[2] == "*"
+	list := line.Args[len(line.Args)-1]
+
+	switch subcmd {
+	case "LS":
+		c.mu.Lock()
+		c.caps.lsBuffer = append(c.caps.lsBuffer, strings.Fields(list)...)
+		if more {
+			c.mu.Unlock()
+			return
+		}
+		for _, token := range c.caps.lsBuffer {
+			name, value, _ := strings.Cut(token, "=")
+			c.caps.available[name] = value
+		}
+		c.caps.lsBuffer = nil
+		negotiating := c.caps.negotiating
+		c.mu.Unlock()
+
+		if negotiating {
+			c.requestCaps()
+		}
+
+	case "ACK":
+		startSASL := false
+		c.mu.Lock()
+		for _, name := range strings.Fields(list) {
+			if strings.HasPrefix(name, "-") {
+				delete(c.caps.enabled, name[1:])
+			} else {
+				c.caps.enabled[name] = true
+				if name == "sasl" && c.caps.negotiating && c.wantsSASL() {
+					startSASL = true
+				}
+			}
+		}
+		if !more && c.caps.pending > 0 {
+			c.caps.pending--
+		}
+		c.mu.Unlock()
+
+		// SASL must complete before CAP END
+		if startSASL {
+			c.startSASL()
+		} else {
+			c.maybeEndCap()
+		}
+
+	case "NAK":
+		c.mu.Lock()
+		if !more && c.caps.pending > 0 {
+			c.caps.pending--
+		}
+		refused := c.caps.negotiating && c.wantsSASL() && contains(strings.Fields(list), "sasl")
+		c.mu.Unlock()
+
+		if refused {
+			c.abortSASL(&RegistrationError{Err: ErrSASLUnavailable, Code: "CAP", Message: "the server refused the sasl capability"})
+			return
+		}
+		c.maybeEndCap()
+
+	case "NEW":
+		c.mu.Lock()
+		for _, token := range strings.Fields(list) {
+			name, value, _ := strings.Cut(token, "=")
+			c.caps.available[name] = value
+		}
+		c.mu.Unlock()
+		c.requestCaps()
+
+	case "DEL":
+		c.mu.Lock()
+		for _, name := range strings.Fields(list) {
+			delete(c.caps.available, name)
+			delete(c.caps.enabled, name)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// wantedCaps returns the configured capabilities plus any implied by
+// other settings (e.g. sasl when credentials are set)
+func (c *Conn) wantedCaps() []string {
+	caps := append([]string(nil), c.cfg.Caps...)
+	if c.wantsSASL() {
+		caps = append(caps, "sasl")
+	}
+	return caps
+}
+
+// requestCaps sends CAP REQ for every wanted capability the server
+// advertises but which isn't enabled yet
+func (c *Conn) requestCaps() {
+	c.mu.Lock()
+	// Don't register unauthenticated when SASL is configured
+	if _, ok := c.caps.available["sasl"]; !ok && c.caps.negotiating && c.wantsSASL() {
+		c.mu.Unlock()
+		c.abortSASL(&RegistrationError{Err: ErrSASLUnavailable, Code: "CAP", Message: "the server doesn't offer the sasl capability"})
+		return
+	}
+	var want []string
+	for _, name := range c.wantedCaps() {
+		if _, ok := c.caps.available[name]; ok && !c.caps.enabled[name] {
+			want = append(want, name)
+		}
+	}
+	if len(want) > 0 {
+		c.caps.pending++
+	}
+	c.mu.Unlock()
+
+	if len(want) > 0 {
+		c.sendRaw("CAP REQ :" + strings.Join(want, " "))
+		return
+	}
+	c.maybeEndCap()
+}
+
+// maybeEndCap sends CAP END once all requests have been answered
+func (c *Conn) maybeEndCap() {
+	c.mu.Lock()
+	if !c.caps.negotiating || c.caps.pending > 0 || c.sasl.active {
+		c.mu.Unlock()
+		return
+	}
+	c.caps.negotiating = false
+	c.mu.Unlock()
+
+	c.sendRaw("CAP END")
+}
+
+// abortCap stops negotiation when the server doesn't support CAP
+func (c *Conn) abortCap() {
+	c.mu.Lock()
+	c.caps.negotiating = false
+	c.caps.pending = 0
+	c.sasl = saslState{}
+	c.mu.Unlock()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// ctcpCommands lists the CTCP queries answered automatically, for
+// CLIENTINFO (ACTION is understood but never answered). Features built
+// on the Conn add theirs with AdvertiseCTCP.
+var ctcpCommands = []string{"ACTION", "CLIENTINFO", "PING", "SOURCE", "TIME", "VERSION"}
+
+// CTCP is a Client-To-Client Protocol message carried in a PRIVMSG
+// (query) or NOTICE (reply), e.g. "\x01PING 1234\x01"
+type CTCP struct {
+	Command string // Uppercased, e.g. "VERSION"
+	Params  string // Everything after the command, if any
+}
+
+// IsCTCP reports whether the line is a PRIVMSG or NOTICE carrying a CTCP
+func (l *Line) IsCTCP() bool {
+	if (l.Cmd != "PRIVMSG" && l.Cmd != "NOTICE") || len(l.Args) < 2 {
+		return false
+	}
+	text := l.Text()
+	return len(text) > 1 && text[0] == '\x01'
+}
+
+// CTCP parses the CTCP carried by the line; the zero value is returned
+// if it isn't one. The closing \x01 is optional, as some clients omit it.
+func (l *Line) CTCP() CTCP {
+	if !l.IsCTCP() {
+		return CTCP{}
+	}
+	text := strings.TrimSuffix(l.Text()[1:], "\x01")
+	cmd, params, _ := strings.Cut(text, " ")
+	return CTCP{Command: strings.ToUpper(cmd), Params: params}
+}
+
+// CTCP sends a CTCP query (e.g. VERSION, or PING with a timestamp) to a
+// target; replies arrive as NOTICEs carrying a CTCP
+func (c *Conn) CTCP(target, command, params string) error {
+	return c.sendCTCP("PRIVMSG", target, command, params)
+}
+
+// CTCPReply answers a CTCP query with a NOTICE
+func (c *Conn) CTCPReply(target, command, params string) error {
+	return c.sendCTCP("NOTICE", target, command, params)
+}
+
+// AdvertiseCTCP registers a CTCP command handled outside the Conn, such
+// as DCC by a DCCManager, so CLIENTINFO lists it
+func (c *Conn) AdvertiseCTCP(command string) {
+	command = strings.ToUpper(command)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !slices.Contains(c.ctcpExtra, command) {
+		c.ctcpExtra = append(c.ctcpExtra, command)
+	}
+}
+
+func (c *Conn) sendCTCP(cmd, target, command, params string) error {
+	command = strings.ToUpper(command)
+	if params == "" {
+		return c.Send(&Line{Cmd: cmd, Args: []string{target, "\x01" + command + "\x01"}})
+	}
+	return c.sendText(cmd, target, params, nil, command)
+}
+
+// handleCTCP answers the CTCP queries in Config.CTCP* automatically,
+// dropping them once the rate limit is hit
+func (c *Conn) handleCTCP(line *Line) {
+	if c.cfg.DisableCTCP || line.Cmd != "PRIVMSG" || line.Nick == "" || !line.IsCTCP() {
+		return
+	}
+
+	c.mu.RLock()
+	// Our own queries come back with echo-message
+	self := c.features.EqualFold(line.Nick, c.nick)
+	c.mu.RUnlock()
+	if self {
+		return
+	}
+
+	query := line.CTCP()
+	reply, ok := c.ctcpReply(query)
+	if !ok {
+		return
+	}
+
+	c.mu.Lock()
+	allowed := c.ctcpLimit == nil || c.ctcpLimit.allow(1)
+	c.mu.Unlock()
+	if allowed {
+		c.CTCPReply(line.Nick, query.Command, reply)
+	}
+}
+
+// ctcpReply returns the automatic reply to a query, if there is one
+func (c *Conn) ctcpReply(query CTCP) (string, bool) {
+	switch query.Command {
+	case "VERSION":
+		return c.cfg.CTCPVersion, c.cfg.CTCPVersion != ""
+	case "SOURCE":
+		return c.cfg.CTCPSource, c.cfg.CTCPSource != ""
+	case "PING":
+		return query.Params, true
+	case "TIME":
+		return time.Now().Format(time.RFC1123Z), true
+	case "CLIENTINFO":
+		var commands []string
+		for _, command := range ctcpCommands {
+			if command == "ACTION" || command == "CLIENTINFO" {
+				commands = append(commands, command)
+			} else if _, ok := c.ctcpReply(CTCP{Command: command}); ok {
+				commands = append(commands, command)
+			}
+		}
+		c.mu.RLock()
+		for _, command := range c.ctcpExtra {
+			if !slices.Contains(commands, command) {
+				commands = append(commands, command)
+			}
+		}
+		c.mu.RUnlock()
+		slices.Sort(commands)
+		return strings.Join(commands, " "), true
+	}
+	return "", false
+}
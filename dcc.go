@@ -0,0 +1,942 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrDCCNeedsPublicIP is returned for DCC offers that need the other
+// side to connect to us while we reach IRC through a proxy: the local
+// address isn't ours to advertise, so DCCManager.PublicIP must be set.
+// Passive (reverse) file offers work without it.
+var ErrDCCNeedsPublicIP = errors.New("DCC through a proxy needs a public IP to advertise")
+
+// dccProgressInterval limits how often progress events are reported for
+// one transfer
+const dccProgressInterval = 250 * time.Millisecond
+
+// dccAckTimeout bounds how long a sender waits for the final
+// acknowledgement once all data is written
+const dccAckTimeout = 30 * time.Second
+
+// DCCKind is the type of a DCC session
+type DCCKind int
+
+const (
+	DCCSend DCCKind = iota // A file we offer
+	DCCGet                 // A file offered to us
+	DCCChat                // A direct chat
+)
+
+func (k DCCKind) String() string {
+	switch k {
+	case DCCSend:
+		return "send"
+	case DCCGet:
+		return "get"
+	case DCCChat:
+		return "chat"
+	default:
+		return "unknown"
+	}
+}
+
+// DCCState is a stage of a DCC session
+type DCCState int
+
+const (
+	DCCOffered    DCCState = iota // Waiting for the other side, or for us to accept
+	DCCConnecting                 // Accepted, setting up the direct connection
+	DCCActive                     // Transferring or chatting
+	DCCDone                       // Finished successfully
+	DCCFailed                     // Ended with an error
+	DCCClosed                     // Closed by us
+)
+
+func (s DCCState) String() string {
+	switch s {
+	case DCCOffered:
+		return "offered"
+	case DCCConnecting:
+		return "connecting"
+	case DCCActive:
+		return "active"
+	case DCCDone:
+		return "done"
+	case DCCFailed:
+		return "failed"
+	case DCCClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// DCCTransfer is a snapshot of a DCC session (a file transfer or a chat)
+type DCCTransfer struct {
+	ID       int
+	Kind     DCCKind
+	State    DCCState
+	Nick     string
+	File     string // Offered file name (send/get)
+	Path     string // Local file (send/get)
+	Size     int64  // Offered size; 0 if unknown
+	Offset   int64  // Position the transfer was resumed from
+	Bytes    int64  // Position reached so far, including Offset
+	Passive  bool   // Reverse DCC: the receiver listens instead of the sender
+	Incoming bool   // Offered to us by Nick
+	Err      error  // Why the session failed
+}
+
+// Progress returns how much of the file has been transferred (0 to 1)
+func (t DCCTransfer) Progress() float64 {
+	if t.Size <= 0 {
+		return 0
+	}
+	return min(float64(t.Bytes)/float64(t.Size), 1)
+}
+
+// DCCEvent reports a change to a DCC session
+type DCCEvent struct {
+	Transfer DCCTransfer
+	Progress bool   // Only the byte count changed
+	Text     string // A line received over DCC CHAT
+}
+
+// DCCManager handles DCC SEND and DCC CHAT for a connection. Offers,
+// RESUME and ACCEPT are exchanged as CTCP messages over IRC; the data
+// flows over a direct TCP connection, which we open through the same
+// proxy as the IRC connection, if any.
+type DCCManager struct {
+	DownloadDir string        // Where received files are saved
+	PublicIP    net.IP        // Address advertised in our offers; defaults to our end of the IRC connection (required behind a proxy)
+	Timeout     time.Duration // How long an offer waits for the other side to connect
+
+	mu       sync.Mutex
+	conn     *Conn
+	sessions map[int]*dccSession
+	lastID   int
+	onEvent  func(DCCEvent)
+	events   []DCCEvent // Waiting for the OnEvent callback, in order
+	emitting bool       // A goroutine is delivering events
+}
+
+// dccSession is a DCC session and its connection state, guarded by
+// DCCManager.mu
+type dccSession struct {
+	DCCTransfer
+	host     string // Remote address to connect to, from the offer
+	port     int    // Port in the offer, identifying it in RESUME and ACCEPT
+	token    string // Reverse DCC token, identifying a passive offer
+	resuming bool   // RESUME sent, waiting for ACCEPT
+	listener net.Listener
+	netConn  net.Conn
+	reported time.Time // Last progress event
+}
+
+// NewDCCManager creates a DCC manager for conn, which handles the DCC
+// offers sent to us from then on
+func NewDCCManager(conn *Conn) *DCCManager {
+	d := &DCCManager{
+		DownloadDir: ".",
+		Timeout:     5 * time.Minute,
+		conn:        conn,
+		sessions:    make(map[int]*dccSession),
+	}
+	conn.HandleFunc(PRIVMSG, d.handleCTCP)
+	conn.AdvertiseCTCP("DCC")
+	return d
+}
+
+// OnEvent sets a callback invoked whenever a session changes. Events are
+// delivered in order from a goroutine of their own, never from the
+// caller of a DCCManager method, so the callback may block.
+func (d *DCCManager) OnEvent(fn func(DCCEvent)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.onEvent = fn
+}
+
+// Transfers returns every session that hasn't been closed, oldest first
+func (d *DCCManager) Transfers() []DCCTransfer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	transfers := make([]DCCTransfer, 0, len(d.sessions))
+	for _, s := range d.sessions {
+		transfers = append(transfers, s.DCCTransfer)
+	}
+	sort.Slice(transfers, func(i, j int) bool { return transfers[i].ID < transfers[j].ID })
+	return transfers
+}
+
+// Send offers a file to nick. With passive (reverse DCC), nick listens
+// and we connect to it, which works when we can't accept connections.
+func (d *DCCManager) Send(nick, path string, passive bool) (int, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if !info.Mode().IsRegular() {
+		return 0, fmt.Errorf("%s is not a regular file", path)
+	}
+
+	s := &dccSession{DCCTransfer: DCCTransfer{
+		Kind:    DCCSend,
+		Nick:    nick,
+		File:    filepath.Base(path),
+		Path:    path,
+		Size:    info.Size(),
+		Passive: passive,
+	}}
+	d.add(s)
+
+	if passive {
+		d.mu.Lock()
+		s.token = strconv.Itoa(s.ID)
+		d.mu.Unlock()
+		// The receiver doesn't need our address; without one, send 0
+		// rather than reveal the local end of a proxy connection
+		ip, ipErr := d.publicIP()
+		if ipErr != nil {
+			ip = net.IPv4zero
+		}
+		err = d.ctcp(nick, "SEND", quoteDCCFile(s.File), formatDCCIP(ip), "0", strconv.FormatInt(s.Size, 10), s.token)
+	} else {
+		err = d.listen(s, "SEND", quoteDCCFile(s.File))
+	}
+	if err != nil {
+		d.remove(s.ID)
+		return 0, err
+	}
+	d.emit(s, false, "")
+	return s.ID, nil
+}
+
+// Chat offers a DCC chat to nick
+func (d *DCCManager) Chat(nick string) (int, error) {
+	s := &dccSession{DCCTransfer: DCCTransfer{Kind: DCCChat, Nick: nick}}
+	d.add(s)
+	if err := d.listen(s, "CHAT", "chat"); err != nil {
+		d.remove(s.ID)
+		return 0, err
+	}
+	d.emit(s, false, "")
+	return s.ID, nil
+}
+
+// Accept accepts a file or chat offered to us. A partially downloaded
+// file is resumed (DCC RESUME) rather than downloaded again.
+func (d *DCCManager) Accept(id int) error {
+	d.mu.Lock()
+	s, ok := d.sessions[id]
+	if !ok {
+		d.mu.Unlock()
+		return fmt.Errorf("no DCC session #%d", id)
+	}
+	if !s.Incoming || s.State != DCCOffered || s.resuming {
+		d.mu.Unlock()
+		return fmt.Errorf("DCC session #%d is not an offer waiting for us", id)
+	}
+
+	if s.Kind == DCCGet {
+		path, offset, err := d.downloadPath(s.File, s.Size)
+		if err != nil {
+			d.mu.Unlock()
+			return err
+		}
+		s.Path = path
+		if offset > 0 {
+			s.resuming = true
+			port := strconv.Itoa(s.port)
+			d.mu.Unlock()
+
+			args := []string{quoteDCCFile(s.File), port, strconv.FormatInt(offset, 10)}
+			if s.token != "" {
+				args = append(args, s.token)
+			}
+			return d.ctcp(s.Nick, "RESUME", args...)
+		}
+	}
+	d.mu.Unlock()
+
+	return d.connectOffer(s)
+}
+
+// Say sends a line over a DCC chat
+func (d *DCCManager) Say(id int, text string) error {
+	d.mu.Lock()
+	s, ok := d.sessions[id]
+	var nc net.Conn
+	if ok && s.Kind == DCCChat && s.State == DCCActive {
+		nc = s.netConn
+	}
+	d.mu.Unlock()
+
+	if nc == nil {
+		return fmt.Errorf("no active DCC chat #%d", id)
+	}
+	if strings.ContainsAny(text, "\r\n") {
+		return fmt.Errorf("%w: contains CR or LF", ErrInvalidLine)
+	}
+	_, err := io.WriteString(nc, text+"\n")
+	return err
+}
+
+// Close ends a session (or declines an offer) and forgets it
+func (d *DCCManager) Close(id int) error {
+	d.mu.Lock()
+	s, ok := d.sessions[id]
+	if !ok {
+		d.mu.Unlock()
+		return fmt.Errorf("no DCC session #%d", id)
+	}
+	delete(d.sessions, id)
+	s.State = DCCClosed
+	listener, nc := s.listener, s.netConn
+	d.mu.Unlock()
+
+	if listener != nil {
+		listener.Close()
+	}
+	if nc != nil {
+		nc.Close()
+	}
+	d.emit(s, false, "")
+	return nil
+}
+
+func (d *DCCManager) add(s *dccSession) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastID++
+	s.ID = d.lastID
+	d.sessions[s.ID] = s
+}
+
+func (d *DCCManager) remove(id int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.sessions, id)
+}
+
+// emit queues a session change for the OnEvent callback
+func (d *DCCManager) emit(s *dccSession, progress bool, text string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.onEvent == nil {
+		return
+	}
+
+	event := DCCEvent{Transfer: s.DCCTransfer, Progress: progress, Text: text}
+	// A newer byte count replaces one not delivered yet
+	if n := len(d.events); progress && n > 0 && d.events[n-1].Progress && d.events[n-1].Transfer.ID == s.ID {
+		d.events[n-1] = event
+	} else {
+		d.events = append(d.events, event)
+	}
+	if !d.emitting {
+		d.emitting = true
+		go d.deliver()
+	}
+}
+
+// deliver passes queued events to the OnEvent callback until none are left
+func (d *DCCManager) deliver() {
+	for {
+		d.mu.Lock()
+		if len(d.events) == 0 {
+			d.emitting = false
+			d.mu.Unlock()
+			return
+		}
+		event, fn := d.events[0], d.onEvent
+		d.events = d.events[1:]
+		d.mu.Unlock()
+
+		if fn != nil {
+			fn(event)
+		}
+	}
+}
+
+// setState moves a session to a new state, unless it was closed
+func (d *DCCManager) setState(s *dccSession, state DCCState, err error) {
+	d.mu.Lock()
+	if s.State == DCCClosed {
+		d.mu.Unlock()
+		return
+	}
+	s.State, s.Err = state, err
+	d.mu.Unlock()
+	d.emit(s, false, "")
+}
+
+// advance records transferred bytes, reporting progress now and then
+func (d *DCCManager) advance(s *dccSession, n int64) {
+	d.mu.Lock()
+	s.Bytes += n
+	report := time.Since(s.reported) >= dccProgressInterval
+	if report {
+		s.reported = time.Now()
+	}
+	d.mu.Unlock()
+
+	if report {
+		d.emit(s, true, "")
+	}
+}
+
+// ctcp sends a DCC message (an offer, RESUME or ACCEPT) to nick
+func (d *DCCManager) ctcp(nick, kind string, args ...string) error {
+	return d.conn.CTCP(nick, "DCC", kind+" "+strings.Join(args, " "))
+}
+
+// publicIP returns the address to advertise in offers: PublicIP, or our
+// end of the IRC connection unless that leads to a proxy
+func (d *DCCManager) publicIP() (net.IP, error) {
+	if d.PublicIP != nil {
+		return d.PublicIP, nil
+	}
+	if d.conn.proxied() {
+		return nil, ErrDCCNeedsPublicIP
+	}
+	if addr, ok := d.conn.LocalAddr().(*net.TCPAddr); ok {
+		return addr.IP, nil
+	}
+	return net.IPv4(127, 0, 0, 1), nil
+}
+
+// dial connects to the other side of a session the way we reach the IRC
+// server, so a proxy isn't bypassed
+func (d *DCCManager) dial(addr string) (net.Conn, error) {
+	dialer, err := d.conn.dialer()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+// listen opens a port for the other side, advertises it with a DCC
+// offer (kind, then the leading args) and serves the session once they
+// connect. Reverse DCC replies carry the size and token after the port.
+func (d *DCCManager) listen(s *dccSession, kind string, args ...string) error {
+	ip, err := d.publicIP()
+	if err != nil {
+		return err
+	}
+	network := "tcp4"
+	if ip.To4() == nil {
+		network = "tcp6"
+	}
+	listener, err := net.Listen(network, ":0")
+	if err != nil {
+		return err
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	d.mu.Lock()
+	s.listener, s.port = listener, port
+	token := s.token
+	d.mu.Unlock()
+
+	args = append(args, formatDCCIP(ip), strconv.Itoa(port))
+	if kind == "SEND" {
+		args = append(args, strconv.FormatInt(s.Size, 10))
+	}
+	if token != "" {
+		args = append(args, token)
+	}
+	if err := d.ctcp(s.Nick, kind, args...); err != nil {
+		listener.Close()
+		return err
+	}
+
+	go d.serve(s, func() (net.Conn, error) {
+		timer := time.AfterFunc(d.Timeout, func() { listener.Close() })
+		nc, err := listener.Accept()
+		listener.Close()
+		if !timer.Stop() {
+			return nil, fmt.Errorf("%s didn't connect within %v", s.Nick, d.Timeout)
+		}
+		return nc, err
+	})
+	return nil
+}
+
+// connectOffer starts an accepted offer: we connect to an active offer,
+// or listen and tell the sender where for a passive (reverse) one
+func (d *DCCManager) connectOffer(s *dccSession) error {
+	d.mu.Lock()
+	s.State = DCCConnecting
+	s.resuming = false
+	passive := s.port == 0 && s.token != ""
+	addr := net.JoinHostPort(s.host, strconv.Itoa(s.port))
+	d.mu.Unlock()
+	d.emit(s, false, "")
+
+	if passive {
+		err := d.listen(s, "SEND", quoteDCCFile(s.File))
+		if err != nil {
+			d.setState(s, DCCFailed, err)
+		}
+		return err
+	}
+
+	go d.serve(s, func() (net.Conn, error) {
+		return d.dial(addr)
+	})
+	return nil
+}
+
+// serve sets up the direct connection for a session and runs it
+func (d *DCCManager) serve(s *dccSession, connect func() (net.Conn, error)) {
+	nc, err := connect()
+	if err != nil {
+		d.setState(s, DCCFailed, err)
+		return
+	}
+	defer nc.Close()
+
+	d.mu.Lock()
+	if s.State == DCCClosed {
+		d.mu.Unlock()
+		return
+	}
+	s.netConn = nc
+	s.State = DCCActive
+	s.Bytes = s.Offset
+	d.mu.Unlock()
+	d.emit(s, false, "")
+
+	switch s.Kind {
+	case DCCSend:
+		err = d.sendFile(s, nc)
+	case DCCGet:
+		err = d.receiveFile(s, nc)
+	case DCCChat:
+		err = d.readChat(s, nc)
+	}
+
+	if err != nil {
+		d.setState(s, DCCFailed, err)
+	} else {
+		d.setState(s, DCCDone, nil)
+	}
+}
+
+// sendFile writes the file from the session's offset, then waits for the
+// receiver to acknowledge all of it
+func (d *DCCManager) sendFile(s *dccSession, nc net.Conn) error {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(s.Offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	// The receiver acknowledges every block with the position reached
+	// (a 32-bit big-endian integer); keep reading so it never blocks
+	acked := make(chan struct{})
+	go func() {
+		defer close(acked)
+		var ack [4]byte
+		for {
+			if _, err := io.ReadFull(nc, ack[:]); err != nil {
+				return
+			}
+			if binary.BigEndian.Uint32(ack[:]) == uint32(s.Size) {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if _, werr := nc.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			d.advance(s, int64(n))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	select {
+	case <-acked:
+	case <-time.After(dccAckTimeout):
+	}
+	return nil
+}
+
+// receiveFile saves the file from the session's offset into its partial
+// file, which is renamed to the final path once complete
+func (d *DCCManager) receiveFile(s *dccSession, nc net.Conn) error {
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0o755); err != nil {
+		return err
+	}
+	part := s.Path + dccPartSuffix
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if s.Offset > 0 {
+		flags = os.O_WRONLY | os.O_APPEND
+	}
+	f, err := os.OpenFile(part, flags, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if err := d.receiveData(s, nc, f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(part, s.Path)
+}
+
+// receiveData copies the file from nc to f, acknowledging each block
+func (d *DCCManager) receiveData(s *dccSession, nc net.Conn, f *os.File) error {
+	pos := s.Offset
+	buf := make([]byte, 32*1024)
+	for s.Size == 0 || pos < s.Size {
+		n, err := nc.Read(buf)
+		if n > 0 {
+			if _, werr := f.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			pos += int64(n)
+			var ack [4]byte
+			binary.BigEndian.PutUint32(ack[:], uint32(pos))
+			nc.Write(ack[:])
+			d.advance(s, int64(n))
+		}
+		if err == io.EOF && s.Size == 0 {
+			return nil
+		}
+		if err == io.EOF {
+			return fmt.Errorf("connection closed after %d of %d bytes", pos, s.Size)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readChat reports the lines received over a DCC chat until it ends
+func (d *DCCManager) readChat(s *dccSession, nc net.Conn) error {
+	scanner := bufio.NewScanner(nc)
+	for scanner.Scan() {
+		d.emit(s, false, strings.TrimRight(scanner.Text(), "\r"))
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// dccPartSuffix marks a file still being downloaded; only these are
+// resumed
+const dccPartSuffix = ".part"
+
+// downloadPath picks where to save an offered file, and the offset to
+// resume from if an earlier download of it was left unfinished. Existing
+// files are never written to: another name is picked instead.
+func (d *DCCManager) downloadPath(file string, size int64) (string, int64, error) {
+	dir := d.DownloadDir
+	if dir == "" {
+		dir = "."
+	}
+
+	name := filepath.Base(strings.ReplaceAll(file, "\\", "/"))
+	if name == "." || name == ".." || name == "/" {
+		name = "download"
+	}
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	for i := 0; ; i++ {
+		path := filepath.Join(dir, name)
+		if i > 0 {
+			path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+		}
+		if _, err := os.Stat(path); err == nil {
+			continue
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return "", 0, err
+		}
+
+		info, err := os.Stat(path + dccPartSuffix)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			return path, 0, nil
+		case err != nil:
+			return "", 0, err
+		case info.Mode().IsRegular() && info.Size() < size:
+			return path, info.Size(), nil
+		}
+		// A partial file we can't resume; leave it alone
+	}
+}
+
+// handleCTCP handles the DCC messages sent to us
+func (d *DCCManager) handleCTCP(c *Conn, line *Line) {
+	ctcp := line.CTCP()
+	if ctcp.Command != "DCC" || line.Nick == "" || c.Features().IsChannel(line.Target()) {
+		return
+	}
+	// Our own offers come back with echo-message
+	if c.Features().EqualFold(line.Nick, c.Me()) {
+		return
+	}
+
+	args := splitDCCArgs(ctcp.Params)
+	if len(args) < 4 {
+		return
+	}
+	switch strings.ToUpper(args[0]) {
+	case "SEND":
+		d.handleSend(line.Nick, args[1:])
+	case "CHAT":
+		d.handleChat(line.Nick, args[1:])
+	case "RESUME":
+		d.handleResume(line.Nick, args[1:])
+	case "ACCEPT":
+		d.handleAccept(line.Nick, args[1:])
+	}
+}
+
+// handleSend handles "SEND <file> <ip> <port> [<size> [<token>]]": a new
+// offer, or the reply to one of our reverse DCC offers
+func (d *DCCManager) handleSend(nick string, args []string) {
+	host := parseDCCIP(args[1])
+	port, err := strconv.Atoi(args[2])
+	if host == "" || err != nil || port < 0 || port > 65535 {
+		return
+	}
+	var size int64
+	if len(args) >= 4 {
+		size, _ = strconv.ParseInt(args[3], 10, 64)
+	}
+	var token string
+	if len(args) >= 5 {
+		token = args[4]
+	}
+
+	// The receiver of a reverse DCC offer tells us where to connect. Only
+	// the first reply to an offer still waiting counts; anything else is
+	// ignored.
+	if port != 0 && token != "" {
+		s := d.find(nick, DCCSend, 0, token)
+		if s == nil {
+			return
+		}
+		d.mu.Lock()
+		ok := s.State == DCCOffered
+		if ok {
+			s.State = DCCConnecting
+		}
+		d.mu.Unlock()
+		if !ok {
+			return
+		}
+		d.emit(s, false, "")
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		go d.serve(s, func() (net.Conn, error) {
+			return d.dial(addr)
+		})
+		return
+	}
+	if port == 0 && token == "" {
+		return
+	}
+
+	s := &dccSession{
+		DCCTransfer: DCCTransfer{
+			Kind:     DCCGet,
+			Nick:     nick,
+			File:     args[0],
+			Size:     size,
+			Passive:  port == 0,
+			Incoming: true,
+		},
+		host:  host,
+		port:  port,
+		token: token,
+	}
+	d.add(s)
+	d.emit(s, false, "")
+}
+
+// handleChat handles "CHAT chat <ip> <port>"
+func (d *DCCManager) handleChat(nick string, args []string) {
+	host := parseDCCIP(args[1])
+	port, err := strconv.Atoi(args[2])
+	if host == "" || err != nil || port <= 0 || port > 65535 {
+		return
+	}
+
+	s := &dccSession{
+		DCCTransfer: DCCTransfer{Kind: DCCChat, Nick: nick, Incoming: true},
+		host:        host,
+		port:        port,
+	}
+	d.add(s)
+	d.emit(s, false, "")
+}
+
+// handleResume handles "RESUME <file> <port> <position> [<token>]" for
+// one of our offers, agreeing with ACCEPT
+func (d *DCCManager) handleResume(nick string, args []string) {
+	port, _ := strconv.Atoi(args[1])
+	position, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return
+	}
+	var token string
+	if len(args) >= 4 {
+		token = args[3]
+	}
+
+	s := d.find(nick, DCCSend, port, token)
+	if s == nil {
+		return
+	}
+	d.mu.Lock()
+	ok := s.State == DCCOffered && position >= 0 && position <= s.Size
+	if ok {
+		s.Offset = position
+	}
+	d.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	reply := []string{quoteDCCFile(s.File), args[1], args[2]}
+	if token != "" {
+		reply = append(reply, token)
+	}
+	d.ctcp(nick, "ACCEPT", reply...)
+}
+
+// handleAccept handles "ACCEPT <file> <port> <position> [<token>]": the
+// sender agreed to resume, so the transfer can start
+func (d *DCCManager) handleAccept(nick string, args []string) {
+	port, _ := strconv.Atoi(args[1])
+	position, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return
+	}
+	var token string
+	if len(args) >= 4 {
+		token = args[3]
+	}
+
+	s := d.find(nick, DCCGet, port, token)
+	if s == nil {
+		return
+	}
+	d.mu.Lock()
+	ok := s.resuming
+	if ok {
+		s.Offset = position
+	}
+	d.mu.Unlock()
+	if ok {
+		d.connectOffer(s)
+	}
+}
+
+// find returns the live (not yet finished) session of a kind with nick
+// matching a port or, for reverse DCC, a token
+func (d *DCCManager) find(nick string, kind DCCKind, port int, token string) *dccSession {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	f := d.conn.Features()
+	for _, s := range d.sessions {
+		if s.Kind != kind || s.State >= DCCDone || !f.EqualFold(s.Nick, nick) {
+			continue
+		}
+		if (token != "" && s.token == token) || (token == "" && port != 0 && s.port == port) {
+			return s
+		}
+	}
+	return nil
+}
+
+// splitDCCArgs splits DCC parameters on spaces, keeping a quoted file
+// name ("my file.txt") together
+func splitDCCArgs(params string) []string {
+	var args []string
+	for params != "" {
+		params = strings.TrimLeft(params, " ")
+		if params == "" {
+			break
+		}
+		if params[0] == '"' {
+			if end := strings.IndexByte(params[1:], '"'); end != -1 {
+				args = append(args, params[1:end+1])
+				params = params[end+2:]
+				continue
+			}
+		}
+		arg, rest, _ := strings.Cut(params, " ")
+		args = append(args, arg)
+		params = rest
+	}
+	return args
+}
+
+// quoteDCCFile quotes a file name containing spaces
+func quoteDCCFile(name string) string {
+	if strings.Contains(name, " ") {
+		return `"` + strings.ReplaceAll(name, `"`, "") + `"`
+	}
+	return name
+}
+
+// formatDCCIP encodes an address for an offer: IPv4 as a 32-bit integer,
+// IPv6 as is
+func formatDCCIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return strconv.FormatUint(uint64(binary.BigEndian.Uint32(ip4)), 10)
+	}
+	return ip.String()
+}
+
+// parseDCCIP decodes the address in an offer, or returns "" if invalid
+func parseDCCIP(s string) string {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		var ip [4]byte
+		binary.BigEndian.PutUint32(ip[:], uint32(n))
+		return net.IP(ip[:]).String()
+	}
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
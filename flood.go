@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// sendQueueSize is how many outgoing lines can wait for flood control
+const sendQueueSize = 1024
+
+// tokenBucket rate-limits outgoing lines. Each line costs one token plus
+// one per penaltyBytes bytes (like the hybrid/ratbox penalty model), and
+// tokens refill at one per rate up to burst.
+type tokenBucket struct {
+	burst        float64
+	rate         time.Duration
+	penaltyBytes int
+	tokens       float64
+	last         time.Time
+}
+
+func newTokenBucket(burst int, rate time.Duration, penaltyBytes int) *tokenBucket {
+	return &tokenBucket{
+		burst:        float64(burst),
+		rate:         rate,
+		penaltyBytes: penaltyBytes,
+		tokens:       float64(burst),
+		last:         time.Now(),
+	}
+}
+
+// cost returns how many tokens a line consumes
+func (b *tokenBucket) cost(line string) float64 {
+	cost := 1.0
+	if b.penaltyBytes > 0 {
+		cost += float64(len(line) / b.penaltyBytes)
+	}
+	// A single line must always be sendable eventually
+	if cost > b.burst {
+		cost = b.burst
+	}
+	return cost
+}
+
+// reserve takes the tokens for a line and returns how long to wait
+// before sending it
+func (b *tokenBucket) reserve(line string) time.Duration {
+	b.refill()
+	b.tokens -= b.cost(line)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens * float64(b.rate))
+}
+
+// allow takes cost tokens if they are available right away, without
+// going into debt like reserve
+func (b *tokenBucket) allow(cost float64) bool {
+	b.refill()
+	if b.tokens < cost {
+		return false
+	}
+	b.tokens -= cost
+	return true
+}
+
+// refill adds the tokens earned since the last call
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens += float64(now.Sub(b.last)) / float64(b.rate)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// bypassesQueue reports whether a line must be sent immediately
+// regardless of flood control (keepalive replies and disconnects)
+func bypassesQueue(cmd string) bool {
+	// Skip any tags prefix
+	if strings.HasPrefix(cmd, "@") {
+		if _, rest, ok := strings.Cut(cmd, " "); ok {
+			cmd = rest
+		}
+	}
+	verb, _, _ := strings.Cut(cmd, " ")
+	switch strings.ToUpper(verb) {
+	case "PONG", "QUIT":
+		return true
+	}
+	return false
+}
+
+// QueueLen returns how many outgoing lines are waiting for flood control
+func (c *Conn) QueueLen() int {
+	return len(c.sendQueue)
+}
+
+// writeLoop drains the send queue for one session, pacing lines with
+// the token bucket
+func (c *Conn) writeLoop(bucket *tokenBucket, quit, done chan struct{}) {
+	for {
+		select {
+		case <-quit:
+			return
+		case <-done:
+			return
+		case cmd := <-c.sendQueue:
+			if wait := bucket.reserve(cmd); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-quit:
+					return
+				case <-done:
+					return
+				}
+			}
+			c.writeLine(cmd)
+		}
+	}
+}
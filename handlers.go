@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// handler is a registered event callback
+type handler struct {
+	id    uint64
+	fn    func(*Conn, *Line)
+	async bool // Run in its own goroutine instead of the dispatcher
+}
+
+// Remover unregisters a handler
+type Remover interface {
+	Remove()
+}
+
+// handlerRef identifies a registered handler
+type handlerRef struct {
+	c     *Conn
+	event string
+	id    uint64
+}
+
+// Remove unregisters the handler; it is safe to call more than once
+func (r handlerRef) Remove() {
+	r.c.removeHandler(r.event, r.id)
+}
+
+// HandleFunc registers a handler for a specific IRC event ("*" for every
+// event). Handlers run one at a time in the order lines arrive, so a
+// handler that blocks (for example in WaitFor) delays all others; use
+// HandleFuncAsync for those.
+func (c *Conn) HandleFunc(event string, fn func(*Conn, *Line)) Remover {
+	return c.addHandler(c.newHandlerRef(event), handler{fn: fn})
+}
+
+// HandleFuncAsync registers a handler that runs in its own goroutine,
+// outside the ordered dispatch, for handlers that may block
+func (c *Conn) HandleFuncAsync(event string, fn func(*Conn, *Line)) Remover {
+	return c.addHandler(c.newHandlerRef(event), handler{fn: fn, async: true})
+}
+
+// HandleOnce registers a handler that is removed after its first call
+func (c *Conn) HandleOnce(event string, fn func(*Conn, *Line)) Remover {
+	var once sync.Once
+	ref := c.newHandlerRef(event)
+	return c.addHandler(ref, handler{fn: func(conn *Conn, line *Line) {
+		once.Do(func() {
+			ref.Remove()
+			fn(conn, line)
+		})
+	}})
+}
+
+// WaitFor blocks until an event matching predicate arrives (any event of
+// that type if predicate is nil) and returns its line, or returns the
+// context's error. For example, to wait for the end of a WHOIS reply:
+//
+//	line, err := conn.WaitFor(ctx, "318", func(l *Line) bool {
+//		return len(l.Args) > 1 && conn.Features().EqualFold(l.Args[1], nick)
+//	})
+//
+// Don't call it from a handler registered with HandleFunc: lines are
+// dispatched one at a time, so the awaited line can't arrive until that
+// handler returns and WaitFor only ends with ctx (or never, without a
+// deadline). Call it from a HandleFuncAsync handler or another goroutine.
+func (c *Conn) WaitFor(ctx context.Context, event string, predicate func(*Line) bool) (*Line, error) {
+	found := make(chan *Line, 1)
+	r := c.HandleFunc(event, func(_ *Conn, line *Line) {
+		if predicate != nil && !predicate(line) {
+			return
+		}
+		select {
+		case found <- line:
+		default:
+			// Already matched
+		}
+	})
+	defer r.Remove()
+
+	select {
+	case line := <-found:
+		return line, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// newHandlerRef reserves an ID for a handler about to be added
+func (c *Conn) newHandlerRef(event string) handlerRef {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlerID++
+	return handlerRef{c: c, event: event, id: c.handlerID}
+}
+
+func (c *Conn) addHandler(ref handlerRef, h handler) Remover {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h.id = ref.id
+	c.handlers[ref.event] = append(c.handlers[ref.event], h)
+	return ref
+}
+
+func (c *Conn) removeHandler(event string, id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Build a new slice: dispatch may be iterating over the old one
+	handlers := c.handlers[event]
+	kept := make([]handler, 0, len(handlers))
+	for _, h := range handlers {
+		if h.id != id {
+			kept = append(kept, h)
+		}
+	}
+	if len(kept) == 0 {
+		delete(c.handlers, event)
+	} else {
+		c.handlers[event] = kept
+	}
+}
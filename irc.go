@@ -2,13 +2,17 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 // IRC event type constants
@@ -20,12 +24,95 @@ const (
 	DISCONNECTED = "DISCONNECTED"
 )
 
+// maxLineLength is the IRC line limit in bytes, including the trailing CRLF
+const maxLineLength = 512
+
+// maxNickAttempts bounds nick fallbacks so a server that keeps rejecting
+// (e.g. truncating) our nick can't loop forever
+const maxNickAttempts = 10
+
+// maxHostLength is assumed for our own host until the server tells us
+// how it relays our prefix
+const maxHostLength = 63
+
+// ErrInvalidLine is returned (wrapped) when an outgoing line can't be
+// serialized safely, e.g. because a parameter contains CR or LF
+var ErrInvalidLine = errors.New("invalid line")
+
 // Line represents a parsed IRC message
 type Line struct {
+	Tags map[string]string // IRCv3 message tags, unescaped
 	Nick string
 	Src  string
 	Cmd  string
 	Args []string
+	Raw  string    // The line as received, without CRLF
+	Time time.Time // From the server-time tag if present, otherwise when received
+}
+
+// Target returns the first parameter: the channel or nick a PRIVMSG,
+// NOTICE, JOIN, PART, MODE... is addressed to (our nick for numerics)
+func (l *Line) Target() string {
+	if len(l.Args) == 0 {
+		return ""
+	}
+	return l.Args[0]
+}
+
+// Text returns the last parameter: the message of a PRIVMSG or NOTICE,
+// the reason of a PART, QUIT or KICK, the text of a numeric
+func (l *Line) Text() string {
+	if len(l.Args) == 0 {
+		return ""
+	}
+	return l.Args[len(l.Args)-1]
+}
+
+// User returns the user (ident) part of a nick!user@host source
+func (l *Line) User() string {
+	_, userHost, ok := strings.Cut(l.Src, "!")
+	if !ok {
+		return ""
+	}
+	user, _, _ := strings.Cut(userHost, "@")
+	return user
+}
+
+// Host returns the host part of a nick!user@host source, or the whole
+// source when it's a server name
+func (l *Line) Host() string {
+	if i := strings.LastIndexByte(l.Src, '@'); i != -1 {
+		return l.Src[i+1:]
+	}
+	if strings.Contains(l.Src, "!") {
+		return ""
+	}
+	return l.Src
+}
+
+// CaseFold lowercases a nick or channel name following a server
+// CASEMAPPING, so names that the server considers equal fold to the same
+// string: "ascii" folds A-Z only, "strict-rfc1459" also folds []\ to {}|,
+// and "rfc1459" (the default for unknown mappings) also folds ~ to ^
+func CaseFold(mapping, name string) string {
+	b := []byte(name)
+	for i, ch := range b {
+		switch {
+		case ch >= 'A' && ch <= 'Z':
+			b[i] = ch + ('a' - 'A')
+		case mapping == "ascii":
+			// Nothing else to fold
+		case ch == '[':
+			b[i] = '{'
+		case ch == ']':
+			b[i] = '}'
+		case ch == '\\':
+			b[i] = '|'
+		case ch == '~' && mapping != "strict-rfc1459":
+			b[i] = '^'
+		}
+	}
+	return string(b)
 }
 
 // Config holds IRC connection configuration
@@ -36,7 +123,48 @@ type Config struct {
 	Server    string
 	SSL       bool
 	SSLConfig *tls.Config
-	NewNick   func(string) string
+	NewNick   func(string) string // Derives a fallback nick when ours is taken during registration
+	AltNicks  []string            // Tried in order before falling back to NewNick
+	Caps      []string            // IRCv3 capabilities to request (CAP negotiation is skipped if empty)
+
+	// SASL credentials; when SASLUser or a TLS client certificate is set,
+	// "sasl" is requested and authentication completes before registration
+	SASLUser     string
+	SASLPassword string
+	SASLMech     string // "PLAIN", "EXTERNAL", "SCRAM-SHA-256" or "SCRAM-SHA-1"; chosen automatically if empty
+
+	// Flood control: lines sent after registration go through a token
+	// bucket holding FloodBurst tokens, refilled at one per FloodRate. Each
+	// line costs one token plus one per FloodPenaltyBytes bytes (0 disables
+	// the byte penalty). FloodBurst <= 0 disables flood control.
+	FloodBurst        int
+	FloodRate         time.Duration
+	FloodPenaltyBytes int
+
+	// CTCP queries (VERSION, PING, TIME, CLIENTINFO, SOURCE) are answered
+	// automatically unless DisableCTCP is set; VERSION and SOURCE only when
+	// their reply is set. At most CTCPBurst replies go out in a row, then
+	// one per CTCPRate; queries beyond that are ignored. CTCPBurst <= 0
+	// disables the limit.
+	DisableCTCP bool
+	CTCPVersion string
+	CTCPSource  string
+	CTCPBurst   int
+	CTCPRate    time.Duration
+
+	// TrackState keeps channel and user state (members, modes, topics,
+	// hostmasks, accounts, away), queried with Channel, Channels and User
+	TrackState bool
+
+	// Dialer makes the TCP connection to the server, e.g. through a custom
+	// proxy; TLS is layered on top when SSL is set. Proxy routes it through
+	// a socks5:// or http:// (CONNECT) proxy URL instead (see ProxyDialer).
+	// A direct connection is made when neither is set.
+	Dialer ContextDialer
+	Proxy  string
+
+	DialTimeout     time.Duration // Bounds the TCP/TLS dial, through the proxy if any (0 = no limit)
+	RegisterTimeout time.Duration // Bounds registration in ConnectContext (0 = no limit)
 }
 
 // NewConfig creates a new IRC configuration with defaults
@@ -48,6 +176,15 @@ func NewConfig(nick string) *Config {
 		NewNick: func(n string) string {
 			return n + "_"
 		},
+		FloodBurst:        5,
+		FloodRate:         2 * time.Second,
+		FloodPenaltyBytes: 256,
+		CTCPVersion:       "irc-client",
+		CTCPSource:        "https://github.com/eznix86/irc-client",
+		CTCPBurst:         3,
+		CTCPRate:          5 * time.Second,
+		DialTimeout:       30 * time.Second,
+		RegisterTimeout:   60 * time.Second,
 	}
 }
 
@@ -57,69 +194,224 @@ type Conn struct {
 	conn        net.Conn
 	connected   bool
 	mu          sync.RWMutex
-	handlers    map[string][]func(*Conn, *Line)
+	handlers    map[string][]handler
+	handlerID   uint64 // Last ID given to a handler, for removal
 	reader      *bufio.Reader
 	writer      *bufio.Writer
-	quit        chan struct{}
-	done        chan struct{}
-	debugSendFn func(string) // Callback for debug logging sent messages
+	writeMu     sync.Mutex                  // Serializes writes from the queue and priority lines
+	sendQueue   chan string                 // Lines waiting for flood control
+	registered  bool                        // Set once RPL_WELCOME is received
+	quit        chan struct{}               // Closed to end the current session
+	done        chan struct{}               // Closed when the current session's read loop exits
+	closed      bool                        // Set by Close; the Conn can't be reused
+	debugSendFn func(string)                // Callback for debug logging sent messages
+	outgoing    []func(*Line) (*Line, bool) // Middleware applied to sent lines (see UseOutgoing)
+	caps        capState
+	sasl        saslState
+	features    Features     // From RPL_ISUPPORT
+	state       stateTracker // Channels and users, when Config.TrackState is set
+	ctcpLimit   *tokenBucket // Rate limit for automatic CTCP replies (nil = none)
+	ctcpExtra   []string     // CTCP commands handled outside the Conn (see AdvertiseCTCP)
+	selfSrc     string       // Our nick!user@host as relayed by the server, once seen
+	nick        string       // Our current nick (attempted nick until registered)
+	nickTries   int          // Fallback nicks tried during registration
+	regResult   chan error   // Receives the outcome of registration, until reported
 }
 
 // Client creates a new IRC connection from config
 func Client(cfg *Config) *Conn {
 	return &Conn{
-		cfg:      cfg,
-		handlers: make(map[string][]func(*Conn, *Line)),
-		quit:     make(chan struct{}),
-		done:     make(chan struct{}),
+		cfg:       cfg,
+		handlers:  make(map[string][]handler),
+		sendQueue: make(chan string, sendQueueSize),
+		caps:      newCapState(),
+		features:  defaultFeatures(),
+		state:     newStateTracker(),
 	}
 }
 
-// HandleFunc registers a handler for a specific IRC event
-func (c *Conn) HandleFunc(event string, handler func(*Conn, *Line)) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.handlers[event] = append(c.handlers[event], handler)
-}
-
-// SetDebugSend sets a callback function for debug logging of sent messages
+// SetDebugSend sets a callback function for debug logging of sent
+// messages. It runs on the sending goroutine with no locks held, and
+// should not block.
 func (c *Conn) SetDebugSend(fn func(string)) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.debugSendFn = fn
 }
 
-// Connect establishes connection to the IRC server
+// Config returns the connection's configuration; changes take effect on
+// the next Connect. Don't change it while connecting or connected; under
+// a Supervisor use ReconnectWith.
+func (c *Conn) Config() *Config {
+	return c.cfg
+}
+
+// Connect establishes connection to the IRC server and returns without
+// waiting for registration (see ConnectContext). A Conn can be connected
+// again after Disconnect or Quit; registered handlers are kept.
 func (c *Conn) Connect() error {
-	var conn net.Conn
-	var err error
+	_, err := c.connect(context.Background())
+	return err
+}
 
-	if c.cfg.SSL {
-		conn, err = tls.Dial("tcp", c.cfg.Server, c.cfg.SSLConfig)
-	} else {
-		conn, err = net.Dial("tcp", c.cfg.Server)
+// connect dials the server and starts registration. The returned channel
+// receives nil on RPL_WELCOME or the reason registration failed.
+func (c *Conn) connect(ctx context.Context) (chan error, error) {
+	c.mu.RLock()
+	closed, connected := c.closed, c.connected
+	c.mu.RUnlock()
+	if closed {
+		return nil, fmt.Errorf("connection is closed")
+	}
+	if connected {
+		return nil, fmt.Errorf("already connected")
 	}
 
+	dialCtx := ctx
+	if c.cfg.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, c.cfg.DialTimeout)
+		defer cancel()
+	}
+	conn, err := c.dial(dialCtx)
 	if err != nil {
-		return fmt.Errorf("failed to connect: %w", err)
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+
+	// Drop lines queued for a previous session
+	for len(c.sendQueue) > 0 {
+		<-c.sendQueue
 	}
 
+	c.mu.Lock()
 	c.conn = conn
 	c.reader = bufio.NewReader(conn)
 	c.writer = bufio.NewWriter(conn)
-
-	c.mu.Lock()
+	c.quit = make(chan struct{})
+	c.done = make(chan struct{})
+	quit, done, reader := c.quit, c.done, c.reader
 	c.connected = true
+	c.registered = false
+	c.nick = c.cfg.Nick
+	c.nickTries = 0
+	c.selfSrc = ""
+	c.features = defaultFeatures()
+	c.state = newStateTracker()
+	c.ctcpLimit = nil
+	if c.cfg.CTCPBurst > 0 && c.cfg.CTCPRate > 0 {
+		c.ctcpLimit = newTokenBucket(c.cfg.CTCPBurst, c.cfg.CTCPRate, 0)
+	}
+	c.regResult = make(chan error, 1)
+	result := c.regResult
 	c.mu.Unlock()
 
+	if c.cfg.FloodBurst > 0 {
+		go c.writeLoop(newTokenBucket(c.cfg.FloodBurst, c.cfg.FloodRate, c.cfg.FloodPenaltyBytes), quit, done)
+	}
+
 	// Send initial IRC handshake (must be after setting connected=true)
-	c.sendRaw(fmt.Sprintf("NICK %s", c.cfg.Nick))
-	c.sendRaw(fmt.Sprintf("USER %s 0 * :%s", c.cfg.User, c.cfg.RealName))
+	// CAP LS goes first so the server holds registration until CAP END
+	c.startCapNegotiation()
+	c.Send(&Line{Cmd: "NICK", Args: []string{c.cfg.Nick}})
+	c.Send(&Line{Cmd: "USER", Args: []string{c.cfg.User, "0", "*", c.cfg.RealName}})
 
-	// Start read loop
-	go c.readLoop()
+	// Start read loop, feeding handlers through the dispatcher
+	queue := newLineQueue()
+	go c.dispatchLoop(queue)
+	go c.readLoop(reader, done, queue)
 
-	return nil
+	return result, nil
+}
+
+// Me returns our current nick as the server knows it
+func (c *Conn) Me() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.nick == "" {
+		return c.cfg.Nick
+	}
+	return c.nick
+}
+
+// Registered returns whether registration completed (RPL_WELCOME received)
+func (c *Conn) Registered() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.registered
+}
+
+// dialer returns how we reach the server: Config.Dialer, or a direct or
+// proxied dialer. DCC connects with it too so the proxy isn't bypassed.
+func (c *Conn) dialer() (ContextDialer, error) {
+	if c.cfg.Dialer != nil {
+		return c.cfg.Dialer, nil
+	}
+	if c.cfg.Proxy != "" {
+		return ProxyDialer(c.cfg.Proxy, &net.Dialer{})
+	}
+	return &net.Dialer{}, nil
+}
+
+// proxied reports whether we reach the server through a proxy or a
+// custom dialer, so our end of the connection isn't our public address
+func (c *Conn) proxied() bool {
+	return c.cfg.Proxy != "" || c.cfg.Dialer != nil
+}
+
+// dial connects to the server, through Config.Dialer or Config.Proxy if
+// set, and starts TLS over that connection when Config.SSL is set
+func (c *Conn) dial(ctx context.Context) (net.Conn, error) {
+	dialer, err := c.dialer()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", c.cfg.Server)
+	if err != nil || !c.cfg.SSL {
+		return conn, err
+	}
+
+	tlsConfig := c.cfg.SSLConfig.Clone()
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName, _, _ = net.SplitHostPort(c.cfg.Server)
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// nextNick tries another nick after ours was rejected during registration:
+// the next of Config.AltNicks, then Config.NewNick applied to the current
+// one. It returns false if there is no nick left to try.
+func (c *Conn) nextNick() bool {
+	c.mu.Lock()
+	if c.registered || c.nickTries >= maxNickAttempts {
+		c.mu.Unlock()
+		return false
+	}
+
+	var nick string
+	if c.nickTries < len(c.cfg.AltNicks) {
+		nick = c.cfg.AltNicks[c.nickTries]
+	} else if c.cfg.NewNick != nil {
+		nick = c.cfg.NewNick(c.nick)
+	}
+	c.nickTries++
+	if nick == "" {
+		c.mu.Unlock()
+		return false
+	}
+	c.nick = nick
+	c.mu.Unlock()
+
+	c.Send(&Line{Cmd: "NICK", Args: []string{nick}})
+	return true
 }
 
 // Connected returns whether the connection is active
@@ -129,48 +421,147 @@ func (c *Conn) Connected() bool {
 	return c.connected
 }
 
-// readLoop continuously reads from the IRC server
-func (c *Conn) readLoop() {
-	defer close(c.done)
+// LocalAddr returns our end of the connection to the server, or nil when
+// not connected
+func (c *Conn) LocalAddr() net.Addr {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.connected || c.conn == nil {
+		return nil
+	}
+	return c.conn.LocalAddr()
+}
+
+// readLoop continuously reads from the IRC server until the socket is
+// closed (by the server or by Disconnect). Protocol state is updated here;
+// lines are then queued for the handlers in arrival order.
+func (c *Conn) readLoop(reader *bufio.Reader, done chan struct{}, queue *lineQueue) {
+	defer close(done)
 	defer func() {
 		c.mu.Lock()
-		c.connected = false
+		// Only reset state if no newer session has started
+		var result chan error
+		if c.done == done {
+			c.connected = false
+			c.registered = false
+			result, c.regResult = c.regResult, nil
+		}
 		c.mu.Unlock()
-		c.dispatch("DISCONNECTED", &Line{Cmd: "DISCONNECTED"})
+		if result != nil {
+			result <- &RegistrationError{Err: ErrConnectionClosed}
+		}
+		queue.push(&Line{Cmd: DISCONNECTED, Time: time.Now()})
+		queue.close()
 	}()
 
 	for {
-		select {
-		case <-c.quit:
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			// Connection closed or error
 			return
-		default:
-			// Set read deadline to allow checking quit channel
-			c.conn.SetReadDeadline(time.Now().Add(1 * time.Second))
-
-			line, err := c.reader.ReadString('\n')
-			if err != nil {
-				// Check if it's a timeout
-				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-					continue
-				}
-				// Connection closed or error
-				return
-			}
+		}
 
-			line = strings.TrimSpace(line)
-			if line == "" {
-				continue
-			}
+		// Only strip the line ending: trailing spaces can be part of
+		// the last parameter
+		line = strings.TrimRight(line, "\r\n")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		parsed := c.parseLine(line)
+		c.track(parsed.Cmd, parsed)
+		queue.push(parsed)
+	}
+}
+
+// dispatchLoop runs handlers for one session's lines, one line at a time
+func (c *Conn) dispatchLoop(queue *lineQueue) {
+	for {
+		line, ok := queue.pop()
+		if !ok {
+			return
+		}
+		c.dispatch(line.Cmd, line)
+	}
+}
+
+// lineQueue passes received lines from the read loop to the dispatcher.
+// It is unbounded so slow handlers never stop us reading from the server
+// (and answering PINGs); lines just wait longer.
+type lineQueue struct {
+	mu     sync.Mutex
+	lines  []*Line
+	closed bool
+	ready  chan struct{} // Signalled when lines are pushed or the queue closes
+}
+
+func newLineQueue() *lineQueue {
+	return &lineQueue{ready: make(chan struct{}, 1)}
+}
+
+func (q *lineQueue) push(line *Line) {
+	q.mu.Lock()
+	q.lines = append(q.lines, line)
+	q.mu.Unlock()
+	q.signal()
+}
+
+// close ends the queue once the lines already in it are popped
+func (q *lineQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.signal()
+}
+
+func (q *lineQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
 
-			parsed := c.parseLine(line)
-			c.dispatch(parsed.Cmd, parsed)
+// pop waits for the next line; it returns false once the queue is closed
+// and empty
+func (q *lineQueue) pop() (*Line, bool) {
+	for {
+		q.mu.Lock()
+		if len(q.lines) > 0 {
+			line := q.lines[0]
+			q.lines[0] = nil
+			q.lines = q.lines[1:]
+			q.mu.Unlock()
+			return line, true
+		}
+		closed := q.closed
+		q.mu.Unlock()
+		if closed {
+			return nil, false
 		}
+		<-q.ready
 	}
 }
 
 // parseLine parses an IRC protocol line
 func (c *Conn) parseLine(raw string) *Line {
-	line := &Line{Args: []string{}}
+	line := &Line{Args: []string{}, Raw: raw, Time: time.Now()}
+
+	// Handle IRCv3 message tags (@key=value;key2=value2)
+	if strings.HasPrefix(raw, "@") {
+		parts := strings.SplitN(raw[1:], " ", 2)
+		if len(parts) < 2 {
+			return line
+		}
+		line.Tags = parseTags(parts[0])
+		raw = strings.TrimLeft(parts[1], " ")
+
+		// server-time: @time=2011-10-19T16:40:51.620Z
+		if ts, ok := line.Tags["time"]; ok {
+			if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+				line.Time = t
+			}
+		}
+	}
 
 	// Handle prefix (source)
 	if strings.HasPrefix(raw, ":") {
@@ -185,33 +576,116 @@ func (c *Conn) parseLine(raw string) *Line {
 			line.Nick = line.Src[:idx]
 		}
 
-		raw = parts[1]
-	}
-
-	// Parse command and parameters
-	parts := strings.Split(raw, " ")
-	if len(parts) == 0 {
-		return line
+		raw = strings.TrimLeft(parts[1], " ")
 	}
 
-	line.Cmd = strings.ToUpper(parts[0])
-	parts = parts[1:]
+	// Parse command and parameters; parameters are separated by one or
+	// more spaces
+	cmd, rest, _ := strings.Cut(raw, " ")
+	line.Cmd = strings.ToUpper(cmd)
 
-	// Parse arguments
-	for i := 0; i < len(parts); i++ {
-		if strings.HasPrefix(parts[i], ":") {
+	for {
+		rest = strings.TrimLeft(rest, " ")
+		if rest == "" {
+			break
+		}
+		if strings.HasPrefix(rest, ":") {
 			// Trailing parameter (contains the rest of the message)
-			line.Args = append(line.Args, strings.Join(parts[i:], " ")[1:])
+			line.Args = append(line.Args, rest[1:])
 			break
 		}
-		line.Args = append(line.Args, parts[i])
+		var arg string
+		arg, rest, _ = strings.Cut(rest, " ")
+		line.Args = append(line.Args, arg)
 	}
 
 	return line
 }
 
-// dispatch calls all registered handlers for an event
-func (c *Conn) dispatch(event string, line *Line) {
+// parseTags parses the tag section of a message (without the leading '@')
+func parseTags(raw string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(raw, ";") {
+		if tag == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(tag, "=")
+		tags[key] = unescapeTagValue(value)
+	}
+	return tags
+}
+
+// unescapeTagValue reverses the IRCv3 tag value escaping
+func unescapeTagValue(value string) string {
+	if !strings.Contains(value, "\\") {
+		return value
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b.WriteByte(value[i])
+			continue
+		}
+		i++
+		if i >= len(value) {
+			// A trailing lone backslash is dropped
+			break
+		}
+		switch value[i] {
+		case ':':
+			b.WriteByte(';')
+		case 's':
+			b.WriteByte(' ')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		default:
+			// Covers `\\` and any unknown escape, which drops the backslash
+			b.WriteByte(value[i])
+		}
+	}
+	return b.String()
+}
+
+// escapeTagValue escapes a tag value for sending
+func escapeTagValue(value string) string {
+	return strings.NewReplacer(
+		"\\", "\\\\",
+		";", "\\:",
+		" ", "\\s",
+		"\r", "\\r",
+		"\n", "\\n",
+	).Replace(value)
+}
+
+// formatTags serializes tags into a message prefix (including '@' and the trailing space)
+func formatTags(tags map[string]string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if v := tags[k]; v != "" {
+			parts = append(parts, k+"="+escapeTagValue(v))
+		} else {
+			parts = append(parts, k)
+		}
+	}
+	return "@" + strings.Join(parts, ";") + " "
+}
+
+// track answers PINGs and updates connection state (capabilities, SASL,
+// registration, our nick and host) before handlers see a line
+func (c *Conn) track(event string, line *Line) {
 	// Handle PING automatically FIRST (before any handlers)
 	if event == "PING" {
 		var pongCmd string
@@ -228,6 +702,135 @@ func (c *Conn) dispatch(event string, line *Line) {
 		}
 	}
 
+	// Handle connection state before handlers see the event
+	c.trackState(line)
+	switch event {
+	case "CAP":
+		c.handleCap(line)
+	case "410", "421": // ERR_INVALIDCAPCMD, ERR_UNKNOWNCOMMAND
+		if len(line.Args) >= 2 && strings.EqualFold(line.Args[1], "CAP") {
+			if c.wantsSASL() && !c.Registered() {
+				c.abortSASL(&RegistrationError{Err: ErrSASLUnavailable, Code: line.Cmd, Message: "the server doesn't support CAP"})
+			} else {
+				c.abortCap()
+			}
+		}
+	case "AUTHENTICATE":
+		c.handleAuthenticate(line)
+	case "902", "903", "904", "905", "906", "907": // ERR_NICKLOCKED, RPL_SASLSUCCESS, ERR_SASLFAIL, ERR_SASLTOOLONG, ERR_SASLABORTED, ERR_SASLALREADY
+		c.finishSASL()
+	case CONNECTED:
+		c.abortCap()
+		c.mu.Lock()
+		c.registered = true
+		if len(line.Args) > 0 {
+			c.nick = line.Args[0]
+		}
+		c.mu.Unlock()
+		c.endRegistration(nil)
+	case "433", "437": // ERR_NICKNAMEINUSE, ERR_UNAVAILRESOURCE
+		if !c.nextNick() {
+			c.failRegistration(line)
+		}
+	case "ERROR", "432", "436", "463", "464", "465":
+		c.failRegistration(line)
+	case "NICK":
+		if len(line.Args) >= 1 && c.Features().EqualFold(line.Nick, c.Me()) {
+			c.mu.Lock()
+			c.nick = line.Args[0]
+			if _, userHost, ok := strings.Cut(line.Src, "!"); ok {
+				c.selfSrc = c.nick + "!" + userHost
+			}
+			c.mu.Unlock()
+		}
+	case "PRIVMSG":
+		c.handleCTCP(line)
+	case "005": // RPL_ISUPPORT
+		c.handleISupport(line)
+	case "396": // RPL_VISIBLEHOST: <nick> <host> :is now your displayed host
+		if len(line.Args) >= 2 {
+			c.setSelfHost("", line.Args[1])
+		}
+	}
+
+	// Learn our own prefix from anything the server relays from us
+	// (JOIN echoes, echo-message, CHGHOST); NICK is handled above
+	if line.Nick != "" && event != "NICK" && c.Features().EqualFold(line.Nick, c.Me()) {
+		if event == "CHGHOST" && len(line.Args) >= 2 {
+			c.setSelfHost(line.Args[0], line.Args[1])
+		} else if strings.Contains(line.Src, "@") {
+			c.mu.Lock()
+			c.selfSrc = line.Src
+			c.mu.Unlock()
+		}
+	}
+}
+
+// serialize formats a line for sending. The last parameter is sent as a
+// trailing parameter when it needs to be. Lines that would be misread by
+// the server (CR, LF or NUL anywhere, a middle parameter that is empty,
+// contains a space or starts with ':') are refused with ErrInvalidLine.
+func (l *Line) serialize() (string, error) {
+	if l.Cmd == "" || strings.ContainsAny(l.Cmd, " :\r\n\x00") {
+		return "", fmt.Errorf("%w: bad command %q", ErrInvalidLine, l.Cmd)
+	}
+	if err := checkTags(l.Tags); err != nil {
+		return "", err
+	}
+	if strings.ContainsAny(l.Src, " \r\n\x00") {
+		return "", fmt.Errorf("%w: bad source %q", ErrInvalidLine, l.Src)
+	}
+	for i, arg := range l.Args {
+		if strings.ContainsAny(arg, "\r\n\x00") {
+			return "", fmt.Errorf("%w: %s parameter contains CR, LF or NUL", ErrInvalidLine, l.Cmd)
+		}
+		if i < len(l.Args)-1 && needsTrailing(arg) {
+			return "", fmt.Errorf("%w: %s middle parameter %q", ErrInvalidLine, l.Cmd, arg)
+		}
+	}
+	return l.String(), nil
+}
+
+// String formats the line in wire format (without CRLF); the last
+// parameter is written as a trailing parameter only when needed. It
+// doesn't validate: only a line accepted by Send (no middle parameter
+// that is empty, starts with ':' or contains a space, no CR/LF/NUL)
+// parses back to the same tags, source, command and parameters.
+func (l *Line) String() string {
+	var b strings.Builder
+	b.WriteString(formatTags(l.Tags))
+	if l.Src != "" {
+		b.WriteString(":" + l.Src + " ")
+	}
+	b.WriteString(l.Cmd)
+	for i, arg := range l.Args {
+		b.WriteByte(' ')
+		if i == len(l.Args)-1 && needsTrailing(arg) {
+			b.WriteByte(':')
+		}
+		b.WriteString(arg)
+	}
+	return b.String()
+}
+
+// needsTrailing reports whether a parameter can only be sent as the
+// trailing (':'-prefixed) parameter
+func needsTrailing(arg string) bool {
+	return arg == "" || strings.HasPrefix(arg, ":") || strings.Contains(arg, " ")
+}
+
+// checkTags refuses tags that can't be escaped into a tag section
+func checkTags(tags map[string]string) error {
+	for key, value := range tags {
+		if key == "" || strings.ContainsAny(key, " ;=\r\n\x00") || strings.ContainsRune(value, 0) {
+			return fmt.Errorf("%w: bad tag %q", ErrInvalidLine, key)
+		}
+	}
+	return nil
+}
+
+// dispatch calls all registered handlers for an event
+func (c *Conn) dispatch(event string, line *Line) {
 	c.mu.RLock()
 	// Get specific event handlers
 	handlers := c.handlers[event]
@@ -235,75 +838,348 @@ func (c *Conn) dispatch(event string, line *Line) {
 	wildcardHandlers := c.handlers["*"]
 	c.mu.RUnlock()
 
-	// Call specific event handlers
-	for _, handler := range handlers {
-		go handler(c, line)
+	// Call specific event handlers, then wildcard handlers
+	for _, h := range append(handlers[:len(handlers):len(handlers)], wildcardHandlers...) {
+		if h.async {
+			go h.fn(c, line)
+		} else {
+			h.fn(c, line)
+		}
+	}
+}
+
+// sendRaw sends a raw IRC command. Once registered, lines are queued
+// behind flood control; registration traffic, PONG and QUIT are written
+// immediately.
+func (c *Conn) sendRaw(cmd string) error {
+	c.mu.RLock()
+	connected, registered := c.connected, c.registered
+	c.mu.RUnlock()
+
+	if !connected {
+		return fmt.Errorf("not connected")
+	}
+
+	cmd, keep, err := c.applyOutgoing(cmd)
+	if err != nil || !keep {
+		return err
+	}
+	if strings.ContainsAny(cmd, "\r\n\x00") {
+		return fmt.Errorf("%w: contains CR, LF or NUL", ErrInvalidLine)
 	}
 
-	// Call wildcard handlers for all events
-	for _, handler := range wildcardHandlers {
-		go handler(c, line)
+	if c.cfg.FloodBurst <= 0 || !registered || bypassesQueue(cmd) {
+		return c.writeLine(cmd)
+	}
+
+	select {
+	case c.sendQueue <- cmd:
+		return nil
+	default:
+		return fmt.Errorf("send queue full")
 	}
 }
 
-// sendRaw sends a raw IRC command
-func (c *Conn) sendRaw(cmd string) error {
+// writeLine writes a line to the socket
+func (c *Conn) writeLine(cmd string) error {
+	// Don't hold c.mu across the write: a stalled socket would block
+	// Disconnect and everything else that takes the lock
 	c.mu.RLock()
-	defer c.mu.RUnlock()
+	connected, writer := c.connected, c.writer
+	debugSendFn := c.debugSendFn
+	c.mu.RUnlock()
 
-	if !c.connected {
+	if !connected {
 		return fmt.Errorf("not connected")
 	}
 
-	// Call debug callback if set
-	if c.debugSendFn != nil {
-		c.debugSendFn(cmd)
+	// Call debug callback if set, before taking writeMu so a slow
+	// callback can't stall the other writers
+	if debugSendFn != nil {
+		debugSendFn(redactSecrets(cmd))
+	}
+
+	// writeMu only keeps concurrent writers from interleaving
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	_, err := writer.WriteString(cmd + "\r\n")
+	if err != nil {
+		return err
 	}
+	return writer.Flush()
+}
 
-	_, err := c.writer.WriteString(cmd + "\r\n")
+// Send serializes a structured line and sends it. Parameters are
+// validated (see ErrInvalidLine) so they can't inject extra commands.
+func (c *Conn) Send(line *Line) error {
+	cmd, err := line.serialize()
 	if err != nil {
 		return err
 	}
-	return c.writer.Flush()
+	return c.sendRaw(cmd)
 }
 
-// Raw sends a raw IRC command
-func (c *Conn) Raw(cmd string) {
-	c.sendRaw(cmd)
+// Raw sends a raw IRC command; it is refused if it contains CR, LF or NUL
+func (c *Conn) Raw(cmd string) error {
+	return c.sendRaw(cmd)
+}
+
+// RawWithTags sends a raw IRC command prefixed with message tags.
+// Client-only tags must be prefixed with '+' (e.g. "+draft/reply").
+func (c *Conn) RawWithTags(tags map[string]string, cmd string) error {
+	if err := checkTags(tags); err != nil {
+		return err
+	}
+	return c.sendRaw(formatTags(tags) + cmd)
 }
 
 // Join joins an IRC channel
-func (c *Conn) Join(channel string) {
-	c.sendRaw(fmt.Sprintf("JOIN %s", channel))
+func (c *Conn) Join(channel string) error {
+	return c.Send(&Line{Cmd: "JOIN", Args: []string{channel}})
+}
+
+// JoinKey joins a channel protected by a key (+k); an empty key is a plain JOIN
+func (c *Conn) JoinKey(channel, key string) error {
+	if key == "" {
+		return c.Join(channel)
+	}
+	return c.Send(&Line{Cmd: "JOIN", Args: []string{channel, key}})
 }
 
 // Part leaves an IRC channel
-func (c *Conn) Part(channel string) {
-	c.sendRaw(fmt.Sprintf("PART %s", channel))
+func (c *Conn) Part(channel string) error {
+	return c.Send(&Line{Cmd: "PART", Args: []string{channel}})
+}
+
+// setSelfHost updates the user and/or host part of our known prefix
+func (c *Conn) setSelfHost(user, host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	nick, oldUser, oldHost := c.nick, "~"+c.cfg.User, ""
+	if c.selfSrc != "" {
+		var userHost string
+		nick, userHost, _ = strings.Cut(c.selfSrc, "!")
+		oldUser, oldHost, _ = strings.Cut(userHost, "@")
+	}
+	if user == "" {
+		user = oldUser
+	}
+	if host == "" {
+		host = oldHost
+	}
+	c.selfSrc = nick + "!" + user + "@" + host
+}
+
+// selfPrefixLen returns the length of the ":nick!user@host " prefix the
+// server adds when relaying our messages. Until it is known, a worst-case
+// host length is assumed.
+func (c *Conn) selfPrefixLen() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.selfSrc != "" && !strings.HasSuffix(c.selfSrc, "@") {
+		return len(c.selfSrc) + 2
+	}
+	// ":" nick "!~" user "@" host " "
+	return 1 + len(c.nick) + 2 + len(c.cfg.User) + 1 + maxHostLength + 1
+}
+
+// lineLen returns the line length limit; servers may raise the
+// 512-byte default with LINELEN
+func (c *Conn) lineLen() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.features.LineLen > 0 {
+		return c.features.LineLen
+	}
+	return maxLineLength
+}
+
+// SplitMessage splits text into chunks that fit in a single
+// "<cmd> <target> :<text>" line once relayed by the server. overhead is
+// any extra bytes wrapped around each chunk (e.g. CTCP framing).
+func (c *Conn) SplitMessage(cmd, target, text string, overhead int) []string {
+	// prefix + "<cmd> <target> :" + text + CRLF
+	budget := c.lineLen() - c.selfPrefixLen() - len(cmd) - len(target) - 3 - 2 - overhead
+	return splitText(text, budget)
+}
+
+// splitText splits s into chunks of at most max bytes, breaking at the
+// last space when possible and never inside a UTF-8 sequence
+func splitText(s string, max int) []string {
+	if max < utf8.UTFMax {
+		max = utf8.UTFMax
+	}
+	if len(s) <= max {
+		return []string{s}
+	}
+
+	var chunks []string
+	for len(s) > max {
+		// Back up to a rune boundary
+		cut := max
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		if cut == 0 {
+			// Not valid UTF-8; cut anywhere
+			cut = max
+		}
+
+		// Prefer breaking at a word boundary, dropping the space itself
+		space := strings.LastIndexByte(s[:cut], ' ')
+		if s[cut] == ' ' {
+			space = cut
+		}
+		if space >= 0 {
+			if space > 0 {
+				chunks = append(chunks, s[:space])
+			}
+			s = s[space+1:]
+		} else {
+			chunks = append(chunks, s[:cut])
+			s = s[cut:]
+		}
+	}
+	if s != "" {
+		chunks = append(chunks, s)
+	}
+	return chunks
+}
+
+// sendText sends text to target as one or more cmd lines, each wrapped
+// in a CTCP command if ctcp is set. Every line is validated before the
+// first is sent, so a bad message is never sent partially.
+func (c *Conn) sendText(cmd, target, text string, tags map[string]string, ctcp string) error {
+	overhead := 0
+	if ctcp != "" {
+		// "\x01" + ctcp + " " + chunk + "\x01"
+		overhead = len(ctcp) + 3
+	}
+
+	var lines []string
+	for _, chunk := range c.SplitMessage(cmd, target, text, overhead) {
+		if ctcp != "" {
+			chunk = "\x01" + ctcp + " " + chunk + "\x01"
+		}
+		line, err := (&Line{Tags: tags, Cmd: cmd, Args: []string{target, chunk}}).serialize()
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line)
+	}
+
+	for _, line := range lines {
+		if err := c.sendRaw(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Privmsg sends a PRIVMSG to a target (channel or user), split into
+// several lines if it's too long
+func (c *Conn) Privmsg(target, message string) error {
+	return c.sendText("PRIVMSG", target, message, nil, "")
+}
+
+// PrivmsgWithTags sends a PRIVMSG carrying message tags; each line of a
+// split message carries the tags
+func (c *Conn) PrivmsgWithTags(target, message string, tags map[string]string) error {
+	return c.sendText("PRIVMSG", target, message, tags, "")
+}
+
+// Notice sends a NOTICE to a target, split into several lines if needed
+func (c *Conn) Notice(target, message string) error {
+	return c.sendText("NOTICE", target, message, nil, "")
 }
 
-// Privmsg sends a PRIVMSG to a target (channel or user)
-func (c *Conn) Privmsg(target, message string) {
-	c.sendRaw(fmt.Sprintf("PRIVMSG %s :%s", target, message))
+// Action sends a CTCP ACTION (/me) to a target, split into several
+// actions if needed
+func (c *Conn) Action(target, text string) error {
+	return c.sendText("PRIVMSG", target, text, nil, "ACTION")
 }
 
-// Quit disconnects from the IRC server with a quit message
+// TagMsg sends a TAGMSG (tags only, no text) to a target
+func (c *Conn) TagMsg(target string, tags map[string]string) error {
+	return c.Send(&Line{Tags: tags, Cmd: "TAGMSG", Args: []string{target}})
+}
+
+// Quit sends QUIT with a message and disconnects once the server closes
+// the link (or after a short timeout). The Conn can be connected again.
 func (c *Conn) Quit(message string) {
-	if message == "" {
-		c.sendRaw("QUIT")
-	} else {
-		c.sendRaw(fmt.Sprintf("QUIT :%s", message))
+	c.mu.RLock()
+	connected, done := c.connected, c.done
+	c.mu.RUnlock()
+
+	quit := &Line{Cmd: "QUIT"}
+	if message != "" {
+		quit.Args = []string{message}
 	}
 
-	close(c.quit)
+	if connected {
+		// Send from another goroutine so a stalled socket can't hold us
+		// up; Disconnect closes it, which fails the write
+		sent := make(chan error, 1)
+		go func() { sent <- c.Send(quit) }()
 
-	// Wait for disconnect or timeout
+		// Give the server a moment to close the link itself
+		timeout := time.After(2 * time.Second)
+		select {
+		case err := <-sent:
+			if err == nil {
+				select {
+				case <-done:
+				case <-timeout:
+				}
+			}
+		case <-timeout:
+		}
+	}
+
+	c.Disconnect()
+}
+
+// Disconnect closes the connection without sending QUIT. Handlers stay
+// registered and Connect can be called again.
+func (c *Conn) Disconnect() {
+	c.mu.Lock()
+	quit, done, conn := c.quit, c.done, c.conn
+	if quit == nil {
+		c.mu.Unlock()
+		return
+	}
 	select {
-	case <-c.done:
-	case <-time.After(2 * time.Second):
+	case <-quit:
+		// Already disconnecting
+	default:
+		close(quit)
 	}
+	c.mu.Unlock()
 
-	if c.conn != nil {
-		c.conn.Close()
+	// Closing the socket unblocks the read loop
+	conn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
 	}
 }
+
+// Close disconnects and releases the Conn for good: handlers are dropped
+// and Connect fails afterwards
+func (c *Conn) Close() {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+
+	c.Disconnect()
+
+	c.mu.Lock()
+	c.handlers = make(map[string][]handler)
+	c.debugSendFn = nil
+	c.outgoing = nil
+	c.mu.Unlock()
+}
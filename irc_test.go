@@ -0,0 +1,1031 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSplitText(t *testing.T) {
+	tests := []struct {
+		in   string
+		max  int
+		want []string
+	}{
+		{"hello", 10, []string{"hello"}},
+		{"hello world", 11, []string{"hello world"}},
+		{"hello world", 8, []string{"hello", "world"}},
+		// Space right at the cut
+		{"hello world", 5, []string{"hello", "world"}},
+		{"héllo wörld foo", 6, []string{"héllo", "wörld", "foo"}},
+		// Space at the start of the window
+		{"a bcdefghij", 4, []string{"a", "bcde", "fghi", "j"}},
+		{" abcdef", 4, []string{"abcd", "ef"}},
+		// No space: hard cut, never inside a rune
+		{"abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		{"ééééé", 5, []string{"éé", "éé", "é"}},
+		{"日本語です", 7, []string{"日本", "語で", "す"}},
+	}
+	for _, tt := range tests {
+		got := splitText(tt.in, tt.max)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitText(%q, %d) = %q, want %q", tt.in, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestLineRoundTrip(t *testing.T) {
+	tests := []*Line{
+		{Cmd: "PING"},
+		{Cmd: "PRIVMSG", Args: []string{"#chan", "hello"}},
+		{Cmd: "PRIVMSG", Args: []string{"#chan", "hello world"}},
+		{Cmd: "PRIVMSG", Args: []string{"#chan", ":-)"}},
+		{Cmd: "PRIVMSG", Args: []string{"#chan", ""}},
+		{Cmd: "PRIVMSG", Args: []string{"#chan", "  spaced  "}},
+		{Cmd: "MODE", Args: []string{"#chan", "+ov", "alice", "bob"}},
+		{Src: "nick!user@host", Nick: "nick", Cmd: "JOIN", Args: []string{"#chan"}},
+		{Src: "irc.example.com", Cmd: "001", Args: []string{"me", "Welcome to IRC"}},
+		{Tags: map[string]string{"msgid": "abc", "+draft/reply": "123"}, Cmd: "TAGMSG", Args: []string{"#chan"}},
+		{Tags: map[string]string{"a": "semi;colon", "b": "sp ace", "c": `back\slash`, "d": "cr\rlf\n", "e": `\:\s`}, Cmd: "PRIVMSG", Args: []string{"#chan", "tags"}},
+		{Tags: map[string]string{"flag": ""}, Cmd: "PRIVMSG", Args: []string{"#chan", "hi"}},
+	}
+	for _, want := range tests {
+		raw, err := want.serialize()
+		if err != nil {
+			t.Errorf("serialize(%+v): %v", want, err)
+			continue
+		}
+		got := (&Conn{}).parseLine(raw)
+		if got.Src != want.Src || got.Nick != want.Nick || got.Cmd != want.Cmd ||
+			!reflect.DeepEqual(got.Args, append([]string{}, want.Args...)) {
+			t.Errorf("%q parsed as src=%q nick=%q cmd=%q args=%q, want src=%q nick=%q cmd=%q args=%q",
+				raw, got.Src, got.Nick, got.Cmd, got.Args, want.Src, want.Nick, want.Cmd, want.Args)
+		}
+		if len(got.Tags) != len(want.Tags) || (len(want.Tags) > 0 && !reflect.DeepEqual(got.Tags, want.Tags)) {
+			t.Errorf("%q parsed with tags %q, want %q", raw, got.Tags, want.Tags)
+		}
+	}
+}
+
+func TestSerializeRejects(t *testing.T) {
+	tests := []*Line{
+		{Cmd: ""},
+		{Cmd: "PRIV MSG"},
+		{Cmd: "PRIVMSG", Args: []string{"#a b", "text"}},
+		{Cmd: "PRIVMSG", Args: []string{":#chan", "text"}},
+		{Cmd: "PRIVMSG", Args: []string{"", "text"}},
+		{Cmd: "PRIVMSG", Args: []string{"#chan", "line\r\nQUIT"}},
+		{Cmd: "PRIVMSG", Args: []string{"#chan", "nul\x00"}},
+		{Src: "bad source", Cmd: "PING"},
+		{Tags: map[string]string{"a b": "x"}, Cmd: "TAGMSG", Args: []string{"#chan"}},
+		{Tags: map[string]string{"a=b": "x"}, Cmd: "TAGMSG", Args: []string{"#chan"}},
+		{Tags: map[string]string{"": "x"}, Cmd: "TAGMSG", Args: []string{"#chan"}},
+	}
+	for _, line := range tests {
+		if raw, err := line.serialize(); !errors.Is(err, ErrInvalidLine) {
+			t.Errorf("serialize(%+v) = %q, %v; want ErrInvalidLine", line, raw, err)
+		}
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want map[string]string
+	}{
+		{"a=1;b=2", map[string]string{"a": "1", "b": "2"}},
+		{"flag;a=", map[string]string{"flag": "", "a": ""}},
+		{`a=x\:y\sz\\w\r\n`, map[string]string{"a": "x;y z\\w\r\n"}},
+		// Unknown escapes drop the backslash, a trailing one is dropped
+		{`a=\b\`, map[string]string{"a": "b"}},
+		{"a=1;;b=2", map[string]string{"a": "1", "b": "2"}},
+	}
+	for _, tt := range tests {
+		if got := parseTags(tt.raw); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseTags(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestChooseSASLMechanism(t *testing.T) {
+	tests := []struct {
+		mech       string
+		advertised string
+		ssl        bool
+		want       string
+		err        error
+	}{
+		{"", "PLAIN,SCRAM-SHA-256", false, "SCRAM-SHA-256", nil},
+		{"", "PLAIN,SCRAM-SHA-1", false, "SCRAM-SHA-1", nil},
+		{"", "PLAIN", false, "", ErrSASLInsecure},
+		{"", "", false, "", ErrSASLInsecure},
+		{"", "PLAIN", true, "PLAIN", nil},
+		{"", "", true, "PLAIN", nil},
+		{"plain", "", false, "PLAIN", nil},
+		{"SCRAM-SHA-256", "PLAIN", false, "SCRAM-SHA-256", nil},
+		{"SCRAM-SHA-512", "", true, "", ErrSASLMechanism},
+		{"SCRAM-SHA256", "", false, "", ErrSASLMechanism},
+	}
+	for _, tt := range tests {
+		cfg := NewConfig("me")
+		cfg.SASLUser, cfg.SASLPassword, cfg.SASLMech, cfg.SSL = "me", "secret", tt.mech, tt.ssl
+		c := Client(cfg)
+		c.caps.available["sasl"] = tt.advertised
+
+		mech, err := c.chooseSASLMechanism()
+		if !errors.Is(err, tt.err) {
+			t.Errorf("mech %q, advertised %q, ssl %v: error %v, want %v", tt.mech, tt.advertised, tt.ssl, err, tt.err)
+			continue
+		}
+		if err == nil && mech.Name() != tt.want {
+			t.Errorf("mech %q, advertised %q, ssl %v: got %s, want %s", tt.mech, tt.advertised, tt.ssl, mech.Name(), tt.want)
+		}
+	}
+}
+
+// serveIRC accepts one client on a loopback listener and calls respond
+// with every line it sends, writing back whatever respond returns. The
+// lines received are returned once the client disconnects.
+func serveIRC(t *testing.T, respond func(line string) []string) (addr string, received <-chan []string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	done := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			done <- nil
+			return
+		}
+		defer conn.Close()
+
+		var lines []string
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				done <- lines
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			lines = append(lines, line)
+			for _, reply := range respond(line) {
+				conn.Write([]byte(reply + "\r\n"))
+			}
+			if strings.HasPrefix(line, "QUIT") {
+				done <- lines
+				return
+			}
+		}
+	}()
+	return ln.Addr().String(), done
+}
+
+func TestSupervisorStopsOnSASLConfigError(t *testing.T) {
+	addr, received := serveIRC(t, func(line string) []string {
+		switch line {
+		case "CAP LS 302":
+			return []string{":irc.test CAP * LS :sasl=PLAIN"}
+		case "CAP REQ :sasl":
+			return []string{":irc.test CAP * ACK :sasl"}
+		}
+		return nil
+	})
+
+	cfg := NewConfig("me")
+	cfg.Server = addr
+	cfg.SASLUser, cfg.SASLPassword = "me", "secret"
+	s := NewSupervisor(Client(cfg))
+	s.MinBackoff = time.Millisecond
+	states := make(chan StateChange, 16)
+	s.OnStateChange(func(change StateChange) { states <- change })
+	s.Start()
+	defer s.Stop("")
+
+	timeout := time.After(5 * time.Second)
+	for stopped := false; !stopped; {
+		select {
+		case change := <-states:
+			if change.State == StateBackoff {
+				t.Fatalf("retrying after %v", change.Err)
+			}
+			if change.State == StateStopped {
+				if !errors.Is(change.Err, ErrSASLInsecure) {
+					t.Fatalf("stopped with %v, want ErrSASLInsecure", change.Err)
+				}
+				stopped = true
+			}
+		case <-timeout:
+			t.Fatal("supervisor didn't stop")
+		}
+	}
+
+	lines := <-received
+	for _, line := range lines {
+		if strings.HasPrefix(line, "AUTHENTICATE") || line == "CAP END" {
+			t.Errorf("sent %q", line)
+		}
+	}
+	if len(lines) == 0 || !strings.HasPrefix(lines[len(lines)-1], "QUIT") {
+		t.Errorf("sent %q, want a QUIT last", lines)
+	}
+}
+
+// ircRelay is a minimal loopback IRC server: it welcomes every client
+// and relays PRIVMSG and NOTICE between them by nick
+type ircRelay struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	users map[string]net.Conn
+}
+
+func newIRCRelay(t *testing.T) *ircRelay {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &ircRelay{ln: ln, users: make(map[string]net.Conn)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *ircRelay) serve(conn net.Conn) {
+	defer conn.Close()
+	var nick string
+	reader := bufio.NewReader(conn)
+	for {
+		raw, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line := (&Conn{}).parseLine(strings.TrimRight(raw, "\r\n"))
+		switch line.Cmd {
+		case "NICK":
+			nick = line.Args[0]
+			r.mu.Lock()
+			r.users[nick] = conn
+			r.mu.Unlock()
+		case "USER":
+			fmt.Fprintf(conn, ":relay 001 %s :Welcome\r\n", nick)
+		case "PRIVMSG", "NOTICE":
+			r.mu.Lock()
+			to := r.users[line.Args[0]]
+			r.mu.Unlock()
+			if to != nil {
+				fmt.Fprintf(to, ":%s!%s@127.0.0.1 %s\r\n", nick, nick, line.Raw)
+			}
+		case "QUIT":
+			return
+		}
+	}
+}
+
+// connectDCC connects a client called nick to the relay and gives it a
+// DCC manager saving into its own directory
+func (r *ircRelay) connectDCC(t *testing.T, nick string) *DCCManager {
+	t.Helper()
+	cfg := NewConfig(nick)
+	cfg.Server = r.ln.Addr().String()
+	c := Client(cfg)
+	d := NewDCCManager(c)
+	d.DownloadDir = t.TempDir()
+	d.Timeout = 5 * time.Second
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.ConnectContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return d
+}
+
+// waitTransfer waits until d has a session matching ok and returns it
+func waitTransfer(t *testing.T, d *DCCManager, ok func(DCCTransfer) bool) DCCTransfer {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, transfer := range d.Transfers() {
+			if ok(transfer) {
+				return transfer
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no matching DCC session in %+v", d.Transfers())
+	return DCCTransfer{}
+}
+
+func isState(state DCCState) func(DCCTransfer) bool {
+	return func(transfer DCCTransfer) bool { return transfer.State == state }
+}
+
+// writeTestFile creates a file of n pseudo-random bytes
+func writeTestFile(t *testing.T, name string, n int) (string, []byte) {
+	t.Helper()
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+func testDCCSend(t *testing.T, passive bool) {
+	r := newIRCRelay(t)
+	alice, bob := r.connectDCC(t, "alice"), r.connectDCC(t, "bob")
+	path, data := writeTestFile(t, "my file.bin", 300*1024)
+
+	if _, err := alice.Send("bob", path, passive); err != nil {
+		t.Fatal(err)
+	}
+	offer := waitTransfer(t, bob, isState(DCCOffered))
+	if offer.File != "my file.bin" || offer.Size != int64(len(data)) || offer.Passive != passive {
+		t.Fatalf("offer %+v", offer)
+	}
+	if err := bob.Accept(offer.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	got := waitTransfer(t, bob, isState(DCCDone))
+	waitTransfer(t, alice, isState(DCCDone))
+	saved, err := os.ReadFile(got.Path)
+	if err != nil || !bytes.Equal(saved, data) {
+		t.Fatalf("saved %d bytes (%v), want %d", len(saved), err, len(data))
+	}
+	if _, err := os.Stat(got.Path + dccPartSuffix); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("partial file left behind: %v", err)
+	}
+}
+
+func TestDCCSendActive(t *testing.T)  { testDCCSend(t, false) }
+func TestDCCSendPassive(t *testing.T) { testDCCSend(t, true) }
+
+func TestDCCResume(t *testing.T) {
+	r := newIRCRelay(t)
+	alice, bob := r.connectDCC(t, "alice"), r.connectDCC(t, "bob")
+	path, data := writeTestFile(t, "file.bin", 200*1024)
+
+	// An unfinished download of the same file
+	part := filepath.Join(bob.DownloadDir, "file.bin"+dccPartSuffix)
+	if err := os.WriteFile(part, data[:70000], 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := alice.Send("bob", path, false); err != nil {
+		t.Fatal(err)
+	}
+	offer := waitTransfer(t, bob, isState(DCCOffered))
+	if err := bob.Accept(offer.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	got := waitTransfer(t, bob, isState(DCCDone))
+	if got.Offset != 70000 {
+		t.Errorf("resumed from %d, want 70000", got.Offset)
+	}
+	if sent := waitTransfer(t, alice, isState(DCCDone)); sent.Offset != 70000 {
+		t.Errorf("sender resumed from %d, want 70000", sent.Offset)
+	}
+	saved, err := os.ReadFile(got.Path)
+	if err != nil || !bytes.Equal(saved, data) {
+		t.Fatalf("saved %d bytes (%v), want %d", len(saved), err, len(data))
+	}
+}
+
+func TestDCCDownloadPath(t *testing.T) {
+	d := &DCCManager{DownloadDir: t.TempDir()}
+	write := func(name string, n int) {
+		if err := os.WriteFile(filepath.Join(d.DownloadDir, name), make([]byte, n), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(file string, size int64, wantName string, wantOffset int64) {
+		t.Helper()
+		path, offset, err := d.downloadPath(file, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Base(path) != wantName || offset != wantOffset {
+			t.Errorf("downloadPath(%q, %d) = %s, %d; want %s, %d", file, size, filepath.Base(path), offset, wantName, wantOffset)
+		}
+	}
+
+	check("notes.txt", 100, "notes.txt", 0)
+	check("../../etc/notes.txt", 100, "notes.txt", 0)
+
+	// An unrelated file is never resumed or overwritten
+	write("notes.txt", 10)
+	check("notes.txt", 100, "notes (1).txt", 0)
+
+	// Our own partial file is
+	write("notes (1).txt.part", 40)
+	check("notes.txt", 100, "notes (1).txt", 40)
+
+	// unless it's no shorter than the offer
+	check("notes.txt", 40, "notes (2).txt", 0)
+}
+
+func TestDCCChat(t *testing.T) {
+	r := newIRCRelay(t)
+	alice, bob := r.connectDCC(t, "alice"), r.connectDCC(t, "bob")
+
+	lines := make(chan string, 4)
+	bob.OnEvent(func(e DCCEvent) {
+		if e.Text != "" {
+			lines <- e.Text
+		}
+	})
+
+	id, err := alice.Chat("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer := waitTransfer(t, bob, isState(DCCOffered))
+	if offer.Kind != DCCChat {
+		t.Fatalf("offer %+v", offer)
+	}
+	if err := bob.Accept(offer.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitTransfer(t, alice, isState(DCCActive))
+
+	if err := alice.Say(id, "hello bob"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case line := <-lines:
+		if line != "hello bob" {
+			t.Errorf("got %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no chat line")
+	}
+
+	if err := alice.Close(id); err != nil {
+		t.Fatal(err)
+	}
+	waitTransfer(t, bob, isState(DCCDone))
+}
+
+func TestSplitDCCArgs(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"SEND file.txt 2130706433 5000 1234", []string{"SEND", "file.txt", "2130706433", "5000", "1234"}},
+		{`SEND "my file.txt" 2130706433 5000`, []string{"SEND", "my file.txt", "2130706433", "5000"}},
+		{"CHAT  chat   2130706433 5000 ", []string{"CHAT", "chat", "2130706433", "5000"}},
+		{`SEND "unterminated 1 2`, []string{"SEND", `"unterminated`, "1", "2"}},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		if got := splitDCCArgs(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitDCCArgs(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseDCCIP(t *testing.T) {
+	tests := map[string]string{
+		"2130706433":  "127.0.0.1",
+		"3232235777":  "192.168.1.1",
+		"0":           "0.0.0.0",
+		"4294967296":  "",
+		"::1":         "::1",
+		"192.168.1.1": "192.168.1.1",
+		"nonsense":    "",
+	}
+	for in, want := range tests {
+		if got := parseDCCIP(in); got != want {
+			t.Errorf("parseDCCIP(%q) = %q, want %q", in, got, want)
+		}
+	}
+	if got := parseDCCIP(formatDCCIP(net.ParseIP("10.1.2.3"))); got != "10.1.2.3" {
+		t.Errorf("formatDCCIP round trip = %q", got)
+	}
+}
+
+func TestDCCOfferThroughProxyNeedsPublicIP(t *testing.T) {
+	cfg := NewConfig("me")
+	cfg.Proxy = "socks5://127.0.0.1:1080"
+	d := NewDCCManager(Client(cfg))
+
+	if _, err := d.Chat("you"); !errors.Is(err, ErrDCCNeedsPublicIP) {
+		t.Errorf("Chat through a proxy: %v, want ErrDCCNeedsPublicIP", err)
+	}
+	if len(d.Transfers()) != 0 {
+		t.Errorf("failed offer kept: %+v", d.Transfers())
+	}
+
+	d.PublicIP = net.ParseIP("192.0.2.1")
+	if ip, err := d.publicIP(); err != nil || !ip.Equal(d.PublicIP) {
+		t.Errorf("publicIP() = %v, %v; want %v", ip, err, d.PublicIP)
+	}
+}
+
+func TestProxyDialerURL(t *testing.T) {
+	for _, raw := range []string{"socks5://127.0.0.1:1080", "socks5h://u:p@proxy:1080", "http://proxy:3128"} {
+		if _, err := ProxyDialer(raw, &net.Dialer{}); err != nil {
+			t.Errorf("ProxyDialer(%q): %v", raw, err)
+		}
+	}
+	for _, raw := range []string{"socks5://proxy", "ftp://proxy:21", "proxy:1080", "://"} {
+		if _, err := ProxyDialer(raw, &net.Dialer{}); err == nil {
+			t.Errorf("ProxyDialer(%q) accepted", raw)
+		}
+	}
+}
+
+// serveProxy accepts one connection on a loopback listener and runs
+// handshake on it; after a successful handshake the connection echoes
+func serveProxy(t *testing.T, handshake func(conn net.Conn, r *bufio.Reader) bool) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		if handshake(conn, r) {
+			io.Copy(conn, r)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// socks5Server answers a SOCKS5 handshake, requiring user/pass when set,
+// and reports the address asked for on target
+func socks5Server(user, pass string, target chan<- string) func(net.Conn, *bufio.Reader) bool {
+	return func(conn net.Conn, r *bufio.Reader) bool {
+		var head [2]byte
+		io.ReadFull(r, head[:])
+		methods := make([]byte, head[1])
+		io.ReadFull(r, methods)
+
+		if user != "" {
+			conn.Write([]byte{0x05, 0x02})
+			var ver [2]byte
+			io.ReadFull(r, ver[:])
+			u := make([]byte, ver[1])
+			io.ReadFull(r, u)
+			n, _ := r.ReadByte()
+			p := make([]byte, n)
+			io.ReadFull(r, p)
+			if string(u) != user || string(p) != pass {
+				conn.Write([]byte{0x01, 0x01})
+				return false
+			}
+			conn.Write([]byte{0x01, 0x00})
+		} else {
+			conn.Write([]byte{0x05, 0x00})
+		}
+
+		var req [4]byte
+		io.ReadFull(r, req[:])
+		var host string
+		switch req[3] {
+		case 0x01:
+			ip := make([]byte, 4)
+			io.ReadFull(r, ip)
+			host = net.IP(ip).String()
+		case 0x03:
+			n, _ := r.ReadByte()
+			name := make([]byte, n)
+			io.ReadFull(r, name)
+			host = string(name)
+		}
+		var port [2]byte
+		io.ReadFull(r, port[:])
+		target <- net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+
+		// Bound to 10.0.0.1:4242
+		conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 10, 0, 0, 1, 0x10, 0x92})
+		return true
+	}
+}
+
+// expectEcho checks that conn is connected to an echoing peer
+func expectEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "PING :x\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "PING :x\r\n" {
+		t.Fatalf("read %q, %v", line, err)
+	}
+}
+
+func TestSOCKS5Dialer(t *testing.T) {
+	target := make(chan string, 1)
+	addr := serveProxy(t, socks5Server("alice", "s3cret", target))
+
+	dialer, err := ProxyDialer("socks5://alice:s3cret@"+addr, &net.Dialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.DialContext(context.Background(), "tcp", "irc.example.onion:6697")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Host names are resolved by the proxy
+	if got := <-target; got != "irc.example.onion:6697" {
+		t.Errorf("proxy asked for %s", got)
+	}
+	expectEcho(t, conn)
+}
+
+func TestSOCKS5DialerIP(t *testing.T) {
+	target := make(chan string, 1)
+	addr := serveProxy(t, socks5Server("", "", target))
+
+	dialer, _ := ProxyDialer("socks5://"+addr, &net.Dialer{})
+	conn, err := dialer.DialContext(context.Background(), "tcp", "192.0.2.7:6667")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := <-target; got != "192.0.2.7:6667" {
+		t.Errorf("proxy asked for %s", got)
+	}
+	expectEcho(t, conn)
+}
+
+func TestSOCKS5DialerBadAuth(t *testing.T) {
+	addr := serveProxy(t, socks5Server("alice", "s3cret", make(chan string, 1)))
+	dialer, _ := ProxyDialer("socks5://alice:wrong@"+addr, &net.Dialer{})
+	if conn, err := dialer.DialContext(context.Background(), "tcp", "irc.example.com:6667"); err == nil {
+		conn.Close()
+		t.Fatal("connected with a bad password")
+	} else if !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("error %v", err)
+	}
+}
+
+// httpProxyServer answers a CONNECT, requiring Basic credentials when
+// auth is set; the server's greeting is sent along with the response
+func httpProxyServer(auth string, target chan<- string) func(net.Conn, *bufio.Reader) bool {
+	return func(conn net.Conn, r *bufio.Reader) bool {
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			return false
+		}
+		target <- req.Method + " " + req.Host
+		if auth != "" && req.Header.Get("Proxy-Authorization") != "Basic "+auth {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return false
+		}
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n:irc.example.com NOTICE * :hello\r\n")
+		return true
+	}
+}
+
+func TestHTTPProxyDialer(t *testing.T) {
+	target := make(chan string, 1)
+	// base64("bob:pw")
+	addr := serveProxy(t, httpProxyServer("Ym9iOnB3", target))
+
+	dialer, _ := ProxyDialer("http://bob:pw@"+addr, &net.Dialer{})
+	conn, err := dialer.DialContext(context.Background(), "tcp", "irc.example.com:6667")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := <-target; got != "CONNECT irc.example.com:6667" {
+		t.Errorf("proxy got %s", got)
+	}
+
+	// Nothing sent by the server with the proxy's response is lost
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	if line, err := r.ReadString('\n'); line != ":irc.example.com NOTICE * :hello\r\n" {
+		t.Fatalf("read %q, %v", line, err)
+	}
+	io.WriteString(conn, "PING :x\r\n")
+	if line, err := r.ReadString('\n'); line != "PING :x\r\n" {
+		t.Fatalf("read %q, %v", line, err)
+	}
+}
+
+func TestHTTPProxyDialerRefused(t *testing.T) {
+	addr := serveProxy(t, httpProxyServer("Ym9iOnB3", make(chan string, 1)))
+	dialer, _ := ProxyDialer("http://"+addr, &net.Dialer{})
+	if conn, err := dialer.DialContext(context.Background(), "tcp", "irc.example.com:6667"); err == nil {
+		conn.Close()
+		t.Fatal("connected without credentials")
+	} else if !strings.Contains(err.Error(), "407") {
+		t.Errorf("error %v", err)
+	}
+}
+
+func TestSASLUnavailable(t *testing.T) {
+	tests := map[string]func(line string) []string{
+		"not offered": func(line string) []string {
+			if line == "CAP LS 302" {
+				return []string{":irc.test CAP * LS :multi-prefix"}
+			}
+			return nil
+		},
+		"refused": func(line string) []string {
+			switch line {
+			case "CAP LS 302":
+				return []string{":irc.test CAP * LS :sasl"}
+			case "CAP REQ :sasl":
+				return []string{":irc.test CAP * NAK :sasl"}
+			}
+			return nil
+		},
+		"no CAP": func(line string) []string {
+			if line == "CAP LS 302" {
+				return []string{":irc.test 421 * CAP :Unknown command"}
+			}
+			return nil
+		},
+	}
+	for name, respond := range tests {
+		t.Run(name, func(t *testing.T) {
+			addr, received := serveIRC(t, respond)
+			cfg := NewConfig("me")
+			cfg.Server = addr
+			cfg.SASLUser, cfg.SASLPassword = "me", "secret"
+			c := Client(cfg)
+			defer c.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := c.ConnectContext(ctx); !errors.Is(err, ErrSASLUnavailable) {
+				t.Fatalf("connect: %v, want ErrSASLUnavailable", err)
+			}
+			for _, line := range <-received {
+				if line == "CAP END" || strings.HasPrefix(line, "AUTHENTICATE") {
+					t.Errorf("sent %q", line)
+				}
+			}
+		})
+	}
+}
+
+func TestPingAnsweredWhileHandlersBlock(t *testing.T) {
+	pong := make(chan struct{})
+	addr, _ := serveIRC(t, func(line string) []string {
+		switch {
+		case strings.HasPrefix(line, "USER "):
+			replies := []string{":irc.test 001 me :Welcome"}
+			for i := 0; i < 1000; i++ {
+				replies = append(replies, fmt.Sprintf(":irc.test NOTICE me :line %d", i))
+			}
+			return append(replies, "PING :still-there")
+		case line == "PONG :still-there" || line == "PONG still-there":
+			close(pong)
+		}
+		return nil
+	})
+
+	cfg := NewConfig("me")
+	cfg.Server = addr
+	c := Client(cfg)
+	defer c.Close()
+	unblock := make(chan struct{})
+	defer close(unblock)
+	c.HandleFunc("NOTICE", func(*Conn, *Line) { <-unblock })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.ConnectContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-pong:
+	case <-time.After(5 * time.Second):
+		t.Fatal("PING not answered while a handler is blocked")
+	}
+}
+
+func TestOwnNickFollowsCasemapping(t *testing.T) {
+	c := Client(NewConfig("Nick["))
+	parse := (&Conn{}).parseLine
+	c.track("005", parse(":irc.test 005 Nick[ CASEMAPPING=rfc1459 :are supported by this server"))
+
+	// The server relays our nick in another case
+	c.track("JOIN", parse(":nick{!user@host JOIN #chan"))
+	c.mu.RLock()
+	src := c.selfSrc
+	c.mu.RUnlock()
+	if src != "nick{!user@host" {
+		t.Errorf("own prefix = %q, want it learned from nick{", src)
+	}
+
+	c.track("NICK", parse(":nick{!user@host NICK other"))
+	if me := c.Me(); me != "other" {
+		t.Errorf("Me() = %q after our NICK change, want other", me)
+	}
+}
+
+func TestCaseFold(t *testing.T) {
+	tests := []struct {
+		mapping, in, want string
+	}{
+		{"ascii", "Nick[]\\~", "nick[]\\~"},
+		{"strict-rfc1459", "Nick[]\\~", "nick{}|~"},
+		{"rfc1459", "Nick[]\\~", "nick{}|^"},
+		{"", "ABC[", "abc{"},
+		{"unknown", "X~", "x^"},
+		{"rfc1459", "#Chan", "#chan"},
+		{"rfc1459", "ÉCOLE", "École"},
+	}
+	for _, tt := range tests {
+		if got := CaseFold(tt.mapping, tt.in); got != tt.want {
+			t.Errorf("CaseFold(%q, %q) = %q, want %q", tt.mapping, tt.in, got, tt.want)
+		}
+	}
+
+	f := defaultFeatures()
+	if !f.EqualFold("Nick[", "nick{") {
+		t.Error("Nick[ and nick{ differ under rfc1459")
+	}
+	f.CaseMapping = "ascii"
+	if f.EqualFold("Nick[", "nick{") {
+		t.Error("Nick[ and nick{ equal under ascii")
+	}
+}
+
+func TestFeaturesApply(t *testing.T) {
+	f := defaultFeatures()
+	f.apply([]string{
+		"PREFIX=(qaohv)~&@%+", "CHANTYPES=#", "CHANMODES=beI,k,l,imnpst", "CASEMAPPING=ascii",
+		"NICKLEN=30", "TOPICLEN=", "TARGMAX=PRIVMSG:4,JOIN:,whois:1", `NETWORK=Test\x20Net`, "MODES", "WHOX",
+	})
+
+	if f.PrefixModes != "qaohv" || f.Prefixes != "~&@%+" {
+		t.Errorf("PREFIX = %q %q", f.PrefixModes, f.Prefixes)
+	}
+	if f.ChanTypes != "#" || f.IsChannel("&local") || !f.IsChannel("#chan") {
+		t.Errorf("CHANTYPES = %q", f.ChanTypes)
+	}
+	if f.ChanModes != [4]string{"beI", "k", "l", "imnpst"} {
+		t.Errorf("CHANMODES = %q", f.ChanModes)
+	}
+	if f.CaseMapping != "ascii" || f.NickLen != 30 || f.TopicLen != 0 || f.Modes != 0 {
+		t.Errorf("CASEMAPPING %q, NICKLEN %d, TOPICLEN %d, MODES %d", f.CaseMapping, f.NickLen, f.TopicLen, f.Modes)
+	}
+	if want := map[string]int{"PRIVMSG": 4, "JOIN": 0, "WHOIS": 1}; !reflect.DeepEqual(f.TargMax, want) {
+		t.Errorf("TARGMAX = %v", f.TargMax)
+	}
+	if f.Network != "Test Net" {
+		t.Errorf("NETWORK = %q", f.Network)
+	}
+	if _, ok := f.Tokens["WHOX"]; !ok {
+		t.Error("WHOX token not recorded")
+	}
+	if prefixes, nick := f.SplitPrefix("~@+nick"); prefixes != "~@+" || nick != "nick" {
+		t.Errorf("SplitPrefix = %q %q", prefixes, nick)
+	}
+
+	// Negation restores the defaults without touching earlier snapshots
+	before := f
+	f.apply([]string{"-PREFIX", "-CHANTYPES", "-CHANMODES", "-CASEMAPPING", "-NICKLEN", "-TARGMAX", "-NETWORK", "-MODES", "-WHOX"})
+	defaults := defaultFeatures()
+	if f.PrefixModes != defaults.PrefixModes || f.Prefixes != defaults.Prefixes || f.ChanTypes != defaults.ChanTypes ||
+		f.ChanModes != defaults.ChanModes || f.CaseMapping != defaults.CaseMapping || f.NickLen != defaults.NickLen ||
+		f.Modes != defaults.Modes || f.Network != "" || len(f.TargMax) != 0 {
+		t.Errorf("after negation: %+v", f)
+	}
+	if _, ok := f.Tokens["WHOX"]; ok {
+		t.Error("WHOX still advertised after -WHOX")
+	}
+	if _, ok := before.Tokens["WHOX"]; !ok || before.TargMax["PRIVMSG"] != 4 {
+		t.Error("earlier Features value changed")
+	}
+}
+
+func TestStateTracker(t *testing.T) {
+	f := defaultFeatures()
+	f.apply([]string{"PREFIX=(qaohv)~&@%+", "CHANMODES=beI,k,l,imnpst", "CASEMAPPING=rfc1459"})
+	s := newStateTracker()
+	parse := (&Conn{}).parseLine
+	update := func(raw string) string { return s.update(parse(raw), f, "me") }
+	member := func(nick string) (Member, bool) {
+		m, ok := s.channels["#chan"].Members[f.Fold(nick)]
+		return m, ok
+	}
+	checkMember := func(nick, modes, prefix string) {
+		t.Helper()
+		m, ok := member(nick)
+		if !ok {
+			t.Errorf("%s not in #chan", nick)
+			return
+		}
+		if m.Modes != modes || m.Prefix != prefix {
+			t.Errorf("%s has modes %q prefix %q, want %q %q", nick, m.Modes, m.Prefix, modes, prefix)
+		}
+	}
+
+	if joined := update(":me!u@host JOIN #Chan"); joined != "#Chan" {
+		t.Fatalf("JOIN returned %q", joined)
+	}
+
+	// NAMES in two batches, with multi-prefix and userhost-in-names
+	update(":irc.test 353 me = #chan :~@alice @+Bob[ me")
+	update(":irc.test 353 me = #chan :+carol!c@carol.host")
+	if _, ok := member("alice"); ok {
+		t.Error("NAMES applied before 366")
+	}
+	update(":irc.test 366 me #chan :End of /NAMES list")
+	checkMember("alice", "qo", "~@")
+	checkMember("bob{", "ov", "@+")
+	checkMember("carol", "v", "+")
+	checkMember("me", "", "")
+	if u := s.users["carol"]; u == nil || u.Host != "carol.host" {
+		t.Errorf("carol = %+v", u)
+	}
+
+	// Channel and membership modes, nick in another case
+	update(":alice!a@host MODE #chan +kl secret 10")
+	update(":alice!a@host MODE #chan +ov-k carol BOB{ secret")
+	checkMember("carol", "ov", "@+")
+	checkMember("bob[", "ov", "@+")
+	if ch := s.channels["#chan"]; !reflect.DeepEqual(ch.Modes, map[byte]string{'l': "10"}) {
+		t.Errorf("channel modes %q", ch.Modes)
+	}
+	update(":alice!a@host MODE #chan -q+b alice *!*@spam")
+	checkMember("alice", "o", "@")
+
+	// WHOX fills in accounts and away status
+	update(":irc.test 354 me 616 #chan a alice.host alice G@ AliceAcct :Alice Real")
+	if u := s.users["alice"]; u == nil || !u.Away || u.Account != "AliceAcct" || u.RealName != "Alice Real" || u.Host != "alice.host" {
+		t.Errorf("alice = %+v", u)
+	}
+
+	// NICK re-keys the user and membership
+	update(":Bob[!b@host NICK Robert")
+	if _, ok := member("bob["); ok {
+		t.Error("old nick still in #chan")
+	}
+	checkMember("robert", "ov", "@+")
+	if u := s.users["robert"]; u == nil || u.Nick != "Robert" {
+		t.Errorf("robert = %+v", u)
+	}
+
+	// KICK and QUIT remove members, and users we no longer see
+	update(":alice!a@host KICK #chan carol :bye")
+	if _, ok := member("carol"); ok {
+		t.Error("carol still in #chan after KICK")
+	}
+	if _, ok := s.users["carol"]; ok {
+		t.Error("carol still tracked after KICK")
+	}
+	update(":Robert!b@host QUIT :gone")
+	if _, ok := member("robert"); ok {
+		t.Error("robert still in #chan after QUIT")
+	}
+
+	// Leaving forgets the channel and everyone in it
+	update(":me!u@host PART #CHAN")
+	if len(s.channels) != 0 {
+		t.Errorf("channels after PART: %v", s.channels)
+	}
+	if _, ok := s.users["alice"]; ok {
+		t.Error("alice still tracked after we left")
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Features holds the server features advertised in RPL_ISUPPORT (005).
+// Until the server sends them, RFC 1459 defaults apply.
+type Features struct {
+	ChanTypes   string            // CHANTYPES: channel name prefixes, e.g. "#&"
+	PrefixModes string            // PREFIX: membership modes, highest first, e.g. "ov"
+	Prefixes    string            // PREFIX: matching nick prefixes, e.g. "@+"
+	ChanModes   [4]string         // CHANMODES: list, always-param, set-param and flag modes
+	NickLen     int               // NICKLEN: maximum nick length (0 = unknown)
+	TopicLen    int               // TOPICLEN: maximum topic length (0 = unknown)
+	LineLen     int               // LINELEN: maximum line length in bytes
+	CaseMapping string            // CASEMAPPING: "rfc1459", "strict-rfc1459" or "ascii"
+	Network     string            // NETWORK: network name, if advertised
+	Modes       int               // MODES: mode changes with a parameter per MODE command (0 = unlimited)
+	TargMax     map[string]int    // TARGMAX: maximum targets per command (0 = unlimited)
+	Tokens      map[string]string // Every advertised token, including unknown ones
+}
+
+// defaultFeatures returns the features to assume before 005 arrives
+func defaultFeatures() Features {
+	return Features{
+		ChanTypes:   "#&",
+		PrefixModes: "ov",
+		Prefixes:    "@+",
+		ChanModes:   [4]string{"b", "k", "l", "imnpst"},
+		NickLen:     9,
+		LineLen:     maxLineLength,
+		CaseMapping: "rfc1459",
+		Modes:       3,
+		TargMax:     map[string]int{},
+		Tokens:      map[string]string{},
+	}
+}
+
+// IsChannel reports whether name is a channel (starts with a CHANTYPES
+// character) rather than a nick
+func (f Features) IsChannel(name string) bool {
+	return name != "" && strings.IndexByte(f.ChanTypes, name[0]) != -1
+}
+
+// Fold casefolds a nick or channel name using the server's CASEMAPPING
+func (f Features) Fold(name string) string {
+	return CaseFold(f.CaseMapping, name)
+}
+
+// EqualFold reports whether two nicks or channel names are the same to
+// the server
+func (f Features) EqualFold(a, b string) bool {
+	return f.Fold(a) == f.Fold(b)
+}
+
+// SplitPrefix splits the membership prefixes off a NAMES entry, e.g.
+// "@+nick" into "@+" and "nick" (several with multi-prefix)
+func (f Features) SplitPrefix(name string) (prefixes, nick string) {
+	i := 0
+	for i < len(name) && strings.IndexByte(f.Prefixes, name[i]) != -1 {
+		i++
+	}
+	return name[:i], name[i:]
+}
+
+// PrefixMode returns the channel mode for a nick prefix ('@' -> 'o'),
+// or 0 if it isn't one
+func (f Features) PrefixMode(prefix byte) byte {
+	if i := strings.IndexByte(f.Prefixes, prefix); i != -1 && i < len(f.PrefixModes) {
+		return f.PrefixModes[i]
+	}
+	return 0
+}
+
+// ModePrefix returns the nick prefix for a membership mode ('o' -> '@'),
+// or 0 if it isn't one
+func (f Features) ModePrefix(mode byte) byte {
+	if i := strings.IndexByte(f.PrefixModes, mode); i != -1 && i < len(f.Prefixes) {
+		return f.Prefixes[i]
+	}
+	return 0
+}
+
+// apply updates the features from the tokens of one 005 line. Maps are
+// copied so values previously returned by Conn.Features stay unchanged.
+func (f *Features) apply(tokens []string) {
+	defaults := defaultFeatures()
+
+	all := make(map[string]string, len(f.Tokens)+len(tokens))
+	for k, v := range f.Tokens {
+		all[k] = v
+	}
+	f.Tokens = all
+
+	for _, token := range tokens {
+		key, value, _ := strings.Cut(token, "=")
+		value = unescapeISupport(value)
+
+		// "-KEY" withdraws a previously advertised token
+		negated := strings.HasPrefix(key, "-")
+		if negated {
+			key = key[1:]
+			delete(f.Tokens, key)
+		} else {
+			f.Tokens[key] = value
+		}
+
+		switch key {
+		case "CHANTYPES":
+			f.ChanTypes = value
+			if negated {
+				f.ChanTypes = defaults.ChanTypes
+			}
+		case "PREFIX":
+			f.PrefixModes, f.Prefixes = defaults.PrefixModes, defaults.Prefixes
+			// (modes)prefixes
+			if modes, prefixes, ok := strings.Cut(strings.TrimPrefix(value, "("), ")"); ok && !negated {
+				f.PrefixModes, f.Prefixes = modes, prefixes
+			} else if value == "" && !negated {
+				f.PrefixModes, f.Prefixes = "", ""
+			}
+		case "CHANMODES":
+			f.ChanModes = defaults.ChanModes
+			if !negated {
+				f.ChanModes = [4]string{}
+				for i, group := range strings.SplitN(value, ",", 4) {
+					f.ChanModes[i] = group
+				}
+			}
+		case "NICKLEN":
+			f.NickLen = isupportInt(value, negated, defaults.NickLen)
+		case "TOPICLEN":
+			f.TopicLen = isupportInt(value, negated, defaults.TopicLen)
+		case "LINELEN":
+			f.LineLen = isupportInt(value, negated, defaults.LineLen)
+		case "CASEMAPPING":
+			f.CaseMapping = value
+			if negated || value == "" {
+				f.CaseMapping = defaults.CaseMapping
+			}
+		case "NETWORK":
+			f.Network = value
+		case "MODES":
+			// MODES without a value means unlimited
+			f.Modes = isupportInt(value, negated, defaults.Modes)
+		case "TARGMAX":
+			f.TargMax = make(map[string]int)
+			if negated {
+				break
+			}
+			for _, entry := range strings.Split(value, ",") {
+				cmd, max, _ := strings.Cut(entry, ":")
+				if cmd != "" {
+					n, _ := strconv.Atoi(max)
+					f.TargMax[strings.ToUpper(cmd)] = n
+				}
+			}
+		}
+	}
+}
+
+// isupportInt parses a numeric token value, falling back to def when
+// the token is withdrawn; an empty value means no limit
+func isupportInt(value string, negated bool, def int) int {
+	if negated {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// unescapeISupport decodes \xHH escapes in a 005 token value
+func unescapeISupport(value string) string {
+	if !strings.Contains(value, `\x`) {
+		return value
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+3 < len(value) && value[i+1] == 'x' {
+			if n, err := strconv.ParseUint(value[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
+
+// Features returns the server's ISUPPORT features
+func (c *Conn) Features() Features {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.features
+}
+
+// handleISupport records the tokens of an RPL_ISUPPORT line
+// Format: 005 <nick> <token>... :are supported by this server
+func (c *Conn) handleISupport(line *Line) {
+	if len(line.Args) < 3 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.features.apply(line.Args[1 : len(line.Args)-1])
+}
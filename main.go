@@ -2,9 +2,13 @@ package main
 
 import (
 	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -55,6 +59,14 @@ var (
 	msgUser = lipgloss.NewStyle().Bold(true)
 	msgBody = lipgloss.NewStyle()
 
+	actionStyle = lipgloss.NewStyle().
+			Foreground(lipgloss.Color("#F472B6")).
+			Italic(true)
+
+	transfersBoxStyle = lipgloss.NewStyle().
+				Border(lipgloss.RoundedBorder()).
+				BorderForeground(borderColor)
+
 	inputBoxStyle = lipgloss.NewStyle().
 			Border(lipgloss.RoundedBorder()).
 			BorderForeground(borderColor).
@@ -79,14 +91,43 @@ var (
 
 	debugStyle = lipgloss.NewStyle().
 			Foreground(lipgloss.Color("#6B7280"))
+
+	pendingStyle = lipgloss.NewStyle().
+			Foreground(lipgloss.Color("#6B7280")).
+			Italic(true)
 )
 
-// IRCEventHandler processes IRC events
-type IRCEventHandler func(m *model, eventType string, data map[string]string)
+// version is set by release builds (-ldflags "-X main.version=...")
+var version = "dev"
+
+// defaultCaps lists the IRCv3 capabilities the client requests
+var defaultCaps = []string{
+	"account-notify", "away-notify", "cap-notify", "chghost", "echo-message",
+	"extended-join", "message-tags", "multi-prefix", "server-time", "userhost-in-names",
+}
+
+// clientOptions holds settings taken from the command line
+type clientOptions struct {
+	verbose      bool // Debug mode
+	saslUser     string
+	saslPassword string
+	saslMech     string
+	clientCert   *tls.Certificate // TLS client certificate for CertFP / SASL EXTERNAL
+	downloadDir  string           // Where files received over DCC are saved
+	proxy        string           // socks5:// or http:// proxy URL
+	dccIP        net.IP           // Address advertised in DCC offers, if not our own
+}
+
+// IRCEventHandler processes IRC events; ts is when the event happened
+// (server-time if available)
+type IRCEventHandler func(m *model, eventType string, ts time.Time, data map[string]string)
 
 // CommandHandler processes user commands
 type CommandHandler func(m *model, args []string) error
 
+// maxTransferRows bounds the height of the transfers panel
+const maxTransferRows = 4
+
 // ─────────────────────────── MODEL ───────────────────────────
 type focusArea int
 
@@ -97,10 +138,19 @@ const (
 	focusUsers
 )
 
+// pendingMessage is a message we sent that is shown greyed out until the
+// server echoes it back (echo-message)
+type pendingMessage struct {
+	target   string
+	text     string
+	action   bool   // Sent with /me
+	rendered string // Placeholder line in m.messages, replaced by the echo
+}
+
 // ircMessage represents a typed IRC event message
 type ircMessage struct {
 	Type      string
-	Timestamp string
+	Timestamp time.Time
 	Data      map[string]string
 }
 
@@ -113,26 +163,31 @@ type model struct {
 	input        textinput.Model
 
 	messages        []string
-	channelUsers    map[string][]string // Users per channel
+	pending         []pendingMessage // Sent messages awaiting their echo
 	channels        []string
+	channelKeys     map[string]string // Keys of joined +k channels, for rejoining
+	ctcpWindows     map[string]string // Window each /ctcp query was sent from, by folded nick
 	channel         string
 	currentTime     time.Time
 	currentFocus    focusArea
 	selectedChanIdx int
 	selectedUserIdx int
+	transferRows    int // Transfers shown in the transfers panel (0 = hidden)
 	showHelp        bool
 
 	inputHistory []string // Command history
 	historyIndex int      // Current position in history (-1 = not browsing)
 	historyTemp  string   // Temporary storage for current input when browsing history
 
-	irc        *Conn
+	sup        *Supervisor // Owns the IRC connection and reconnects it
+	dcc        *DCCManager // DCC file transfers and chats
+	connState  string      // Connection state shown in the status bar
 	nick       string
 	ircMsgChan chan ircMessage
 	server     string
 	port       string
 	useTLS     bool
-	verbose    bool // Debug mode
+	opts       clientOptions
 
 	// Handler registries
 	ircEventHandlers map[string]IRCEventHandler
@@ -141,7 +196,7 @@ type model struct {
 
 type tickMsg time.Time
 
-func initialModel(server, port, nick string, verbose bool) model {
+func initialModel(server, port, nick string, opts clientOptions) model {
 	inp := textinput.New()
 	inp.Placeholder = "Type a message..."
 	inp.Prompt = "> "
@@ -152,29 +207,15 @@ func initialModel(server, port, nick string, verbose bool) model {
 	chat := viewport.New(80, 20)
 	usersView := viewport.New(sidebarWidth, 20)
 
-	// Determine if we should use TLS based on common TLS ports
-	useTLS := port == "6697" || port == "7000" || port == "7001" || port == "9999"
-
-	// Setup IRC connection
-	cfg := NewConfig(nick)
-	cfg.SSL = useTLS
-	cfg.Server = fmt.Sprintf("%s:%s", server, port)
-	cfg.NewNick = func(n string) string { return n + "_" }
-
-	// Configure TLS
-	if useTLS {
-		cfg.SSLConfig = &tls.Config{
-			InsecureSkipVerify: true,
-		}
-	}
+	useTLS := isTLSPort(port)
 
-	c := Client(cfg)
 	msgChan := make(chan ircMessage, 100)
 
 	m := model{
 		messages:         []string{},
-		channelUsers:     make(map[string][]string),
 		channels:         []string{},
+		channelKeys:      make(map[string]string),
+		ctcpWindows:      make(map[string]string),
 		channel:          "",
 		channelsView:     channelsView,
 		chat:             chat,
@@ -187,20 +228,49 @@ func initialModel(server, port, nick string, verbose bool) model {
 		inputHistory:     []string{},
 		historyIndex:     -1,
 		historyTemp:      "",
-		irc:              c,
 		nick:             nick,
 		ircMsgChan:       msgChan,
 		server:           server,
 		port:             port,
 		useTLS:           useTLS,
-		verbose:          verbose,
+		opts:             opts,
 		ircEventHandlers: make(map[string]IRCEventHandler),
 		commandHandlers:  make(map[string]CommandHandler),
 	}
 
+	// Setup IRC connection, kept alive by the supervisor
+	conn := Client(m.newIRCConfig(useTLS))
+	m.setupIRCHandlers(conn)
+	m.sup = NewSupervisor(conn)
+	m.sup.OnStateChange(func(change StateChange) {
+		data := map[string]string{
+			"state":   change.State.String(),
+			"attempt": fmt.Sprint(change.Attempt),
+		}
+		if change.State == StateBackoff {
+			data["delay"] = change.Delay.Round(time.Second).String()
+		}
+		if change.Err != nil {
+			data["error"] = change.Err.Error()
+		}
+		// SASL problems are auth failures like 904, shown the same way
+		if change.State == StateBackoff && isSASLError(change.Err) {
+			msgChan <- ircMessage{Type: "ERROR", Timestamp: time.Now(), Data: map[string]string{"message": "SASL: " + change.Err.Error()}}
+			delete(data, "error")
+		}
+		msgChan <- ircMessage{Type: "STATE", Timestamp: time.Now(), Data: data}
+	})
+
+	// DCC sessions report their progress through the same channel
+	m.dcc = NewDCCManager(conn)
+	m.dcc.DownloadDir = opts.downloadDir
+	m.dcc.PublicIP = opts.dccIP
+	m.dcc.OnEvent(func(e DCCEvent) {
+		msgChan <- ircMessage{Type: "DCC", Timestamp: time.Now(), Data: dccEventData(e)}
+	})
+
 	// Setup IRC and command handlers
 	m.registerIRCEventHandlers()
-	m.setupIRCHandlers()
 	m.setupCommandHandlers()
 
 	m.updateSidebars()
@@ -208,91 +278,185 @@ func initialModel(server, port, nick string, verbose bool) model {
 	return m
 }
 
-func (m *model) setupIRCHandlers() {
-	// Helper to send typed messages
-	send := func(msgType string, data map[string]string) {
+// conn returns the current IRC connection
+func (m *model) conn() *Conn {
+	return m.sup.Conn()
+}
+
+// newIRCConfig builds the connection config from the model's settings
+func (m *model) newIRCConfig(useTLS bool) *Config {
+	cfg := NewConfig(m.nick)
+	cfg.SSL = useTLS
+	cfg.Server = fmt.Sprintf("%s:%s", m.server, m.port)
+	cfg.NewNick = func(n string) string { return n + "_" }
+	cfg.Caps = defaultCaps
+	cfg.TrackState = true
+	cfg.CTCPVersion = "irc-client " + version
+	cfg.SASLUser = m.opts.saslUser
+	cfg.SASLPassword = m.opts.saslPassword
+	cfg.SASLMech = m.opts.saslMech
+	cfg.Proxy = m.opts.proxy
+
+	// Configure TLS
+	if useTLS {
+		cfg.SSLConfig = &tls.Config{
+			InsecureSkipVerify: true,
+		}
+		if m.opts.clientCert != nil {
+			cfg.SSLConfig.Certificates = []tls.Certificate{*m.opts.clientCert}
+		}
+	}
+	return cfg
+}
+
+func (m *model) setupIRCHandlers(c *Conn) {
+	// Helper to send typed messages, stamped with the line's time
+	send := func(line *Line, msgType string, data map[string]string) {
+		ts := time.Now()
+		if line != nil && !line.Time.IsZero() {
+			ts = line.Time
+		}
 		m.ircMsgChan <- ircMessage{
 			Type:      msgType,
-			Timestamp: time.Now().Format("15:04"),
+			Timestamp: ts,
 			Data:      data,
 		}
 	}
 
 	// Wildcard handler for debug mode - logs all IRC events
-	if m.verbose {
+	if m.opts.verbose {
 		// Log received messages
-		m.irc.HandleFunc("*", func(conn *Conn, line *Line) {
-			msg := fmt.Sprintf("RECV CMD=%s NICK=%s SRC=%s ARGS=%v", line.Cmd, line.Nick, line.Src, line.Args)
-			send("DEBUG", map[string]string{"message": msg})
+		c.HandleFunc("*", func(conn *Conn, line *Line) {
+			raw := line.Raw
+			if raw == "" {
+				// Synthetic events (DISCONNECTED) have no wire text
+				raw = line.String()
+			}
+			msg := fmt.Sprintf("RECV %s", raw)
+			send(line, "DEBUG", map[string]string{"message": msg})
 		})
 
-		// Log sent messages
-		m.irc.SetDebugSend(func(cmd string) {
+		// Log sent messages. Senders include the read loop (PONG), so
+		// drop the log line rather than block when the TUI falls behind.
+		c.SetDebugSend(func(cmd string) {
 			msg := fmt.Sprintf("SEND %s", cmd)
-			send("DEBUG", map[string]string{"message": msg})
+			select {
+			case m.ircMsgChan <- ircMessage{Type: "DEBUG", Timestamp: time.Now(), Data: map[string]string{"message": msg}}:
+			default:
+			}
 		})
 	}
 
-	m.irc.HandleFunc("001", func(conn *Conn, line *Line) {
-		send("CONNECTED", map[string]string{"message": "Connected to server"})
+	c.HandleFunc("001", func(conn *Conn, line *Line) {
+		send(line, "CONNECTED", map[string]string{
+			"message": "Connected to server",
+			"nick":    conn.Me(),
+		})
 	})
 
-	m.irc.HandleFunc("PRIVMSG", func(conn *Conn, line *Line) {
+	c.HandleFunc("NICK", func(conn *Conn, line *Line) {
+		if len(line.Args) >= 1 {
+			send(line, "NICK", map[string]string{
+				"nick":    line.Nick,
+				"newnick": line.Args[0],
+			})
+		}
+	})
+
+	c.HandleFunc("PRIVMSG", func(conn *Conn, line *Line) {
+		// CTCP queries; the connection answers them itself and DCC offers
+		// are reported by the DCC manager
+		if ctcp := line.CTCP(); line.IsCTCP() && ctcp.Command != "ACTION" {
+			if ctcp.Command != "DCC" {
+				send(line, "CTCP", map[string]string{
+					"nick":    line.Nick,
+					"target":  line.Args[0],
+					"command": ctcp.Command,
+					"params":  ctcp.Params,
+				})
+			}
+			return
+		}
 		if len(line.Args) >= 2 {
-			send("PRIVMSG", map[string]string{
+			data := map[string]string{
 				"nick":    line.Nick,
 				"target":  line.Args[0],
 				"message": line.Args[1],
-			})
+			}
+			// /me
+			if ctcp := line.CTCP(); ctcp.Command == "ACTION" {
+				data["message"] = ctcp.Params
+				data["action"] = "1"
+			}
+			send(line, "PRIVMSG", data)
 		}
 	})
 
-	m.irc.HandleFunc("JOIN", func(conn *Conn, line *Line) {
+	c.HandleFunc("JOIN", func(conn *Conn, line *Line) {
 		if len(line.Args) >= 1 {
-			send("JOIN", map[string]string{
+			send(line, "JOIN", map[string]string{
 				"nick":    line.Nick,
 				"channel": line.Args[0],
 			})
 		}
 	})
 
-	m.irc.HandleFunc("PART", func(conn *Conn, line *Line) {
+	c.HandleFunc("PART", func(conn *Conn, line *Line) {
 		if len(line.Args) >= 1 {
-			send("PART", map[string]string{
+			send(line, "PART", map[string]string{
 				"nick":    line.Nick,
 				"channel": line.Args[0],
 			})
 		}
 	})
 
-	m.irc.HandleFunc("QUIT", func(conn *Conn, line *Line) {
+	c.HandleFunc("QUIT", func(conn *Conn, line *Line) {
 		data := map[string]string{"nick": line.Nick}
 		if len(line.Args) >= 1 {
 			data["reason"] = line.Args[0]
 		}
-		send("QUIT", data)
+		send(line, "QUIT", data)
 	})
 
-	m.irc.HandleFunc("353", func(conn *Conn, line *Line) { // RPL_NAMREPLY
-		if len(line.Args) >= 4 {
-			send("NAMES", map[string]string{
-				"channel": line.Args[2],
-				"users":   line.Args[3],
+	c.HandleFunc("KICK", func(conn *Conn, line *Line) {
+		if len(line.Args) >= 2 {
+			data := map[string]string{
+				"nick":    line.Nick,
+				"channel": line.Args[0],
+				"victim":  line.Args[1],
+			}
+			if len(line.Args) >= 3 {
+				data["reason"] = line.Args[2]
+			}
+			send(line, "KICK", data)
+		}
+	})
+
+	c.HandleFunc("MODE", func(conn *Conn, line *Line) {
+		if len(line.Args) >= 2 {
+			nick := line.Nick
+			if nick == "" {
+				nick = line.Src
+			}
+			send(line, "MODE", map[string]string{
+				"nick":   nick,
+				"target": line.Args[0],
+				"modes":  strings.Join(line.Args[1:], " "),
 			})
 		}
 	})
 
-	m.irc.HandleFunc("366", func(conn *Conn, line *Line) { // RPL_ENDOFNAMES
+	c.HandleFunc("366", func(conn *Conn, line *Line) { // RPL_ENDOFNAMES
 		if len(line.Args) >= 2 {
-			send("ENDOFNAMES", map[string]string{
+			send(line, "ENDOFNAMES", map[string]string{
 				"channel": line.Args[1],
 			})
 		}
 	})
 
-	m.irc.HandleFunc("322", func(conn *Conn, line *Line) { // RPL_LIST
+	c.HandleFunc("322", func(conn *Conn, line *Line) { // RPL_LIST
 		if len(line.Args) >= 4 {
-			send("LIST", map[string]string{
+			send(line, "LIST", map[string]string{
 				"channel": line.Args[1],
 				"users":   line.Args[2],
 				"topic":   line.Args[3],
@@ -300,64 +464,73 @@ func (m *model) setupIRCHandlers() {
 		}
 	})
 
-	m.irc.HandleFunc("323", func(conn *Conn, line *Line) { // RPL_LISTEND
-		send("LISTEND", map[string]string{"message": "End of channel list"})
+	c.HandleFunc("323", func(conn *Conn, line *Line) { // RPL_LISTEND
+		send(line, "LISTEND", map[string]string{"message": "End of channel list"})
 	})
 
-	m.irc.HandleFunc("321", func(conn *Conn, line *Line) { // RPL_LISTSTART
-		send("LISTSTART", map[string]string{"message": "Channel list:"})
+	c.HandleFunc("321", func(conn *Conn, line *Line) { // RPL_LISTSTART
+		send(line, "LISTSTART", map[string]string{"message": "Channel list:"})
 	})
 
 	// Helper for server info messages (002, 003, 004, 005, 251-255, 265-266)
 	sendServerInfo := func(conn *Conn, line *Line) {
 		if len(line.Args) > 0 {
-			send("SERVER_INFO", map[string]string{
+			send(line, "SERVER_INFO", map[string]string{
 				"message": strings.Join(line.Args, " "),
 			})
 		}
 	}
 
-	m.irc.HandleFunc("001", func(conn *Conn, line *Line) { // RPL_WELCOME
+	c.HandleFunc("001", func(conn *Conn, line *Line) { // RPL_WELCOME
 		if len(line.Args) > 0 {
-			send("WELCOME", map[string]string{
+			send(line, "WELCOME", map[string]string{
 				"message": strings.Join(line.Args, " "),
 			})
 		}
 	})
 
 	// RPL_YOURHOST, RPL_CREATED, RPL_MYINFO, RPL_ISUPPORT
-	m.irc.HandleFunc("002", sendServerInfo)
-	m.irc.HandleFunc("003", sendServerInfo)
-	m.irc.HandleFunc("004", sendServerInfo)
-	m.irc.HandleFunc("005", sendServerInfo)
+	c.HandleFunc("002", sendServerInfo)
+	c.HandleFunc("003", sendServerInfo)
+	c.HandleFunc("004", sendServerInfo)
+	c.HandleFunc("005", sendServerInfo)
 
 	// Helper for MOTD messages
 	sendMOTD := func(conn *Conn, line *Line) {
 		if len(line.Args) > 0 {
-			send("MOTD", map[string]string{
+			send(line, "MOTD", map[string]string{
 				"message": strings.Join(line.Args, " "),
 			})
 		}
 	}
 
 	// RPL_MOTDSTART, RPL_MOTD, RPL_ENDOFMOTD
-	m.irc.HandleFunc("375", sendMOTD)
-	m.irc.HandleFunc("372", sendMOTD)
-	m.irc.HandleFunc("376", sendMOTD)
+	c.HandleFunc("375", sendMOTD)
+	c.HandleFunc("372", sendMOTD)
+	c.HandleFunc("376", sendMOTD)
 
 	// RPL_LUSERCLIENT, RPL_LUSERME, RPL_LOCALUSERS, RPL_GLOBALUSERS
-	m.irc.HandleFunc("251", sendServerInfo)
-	m.irc.HandleFunc("255", sendServerInfo)
-	m.irc.HandleFunc("265", sendServerInfo)
-	m.irc.HandleFunc("266", sendServerInfo)
+	c.HandleFunc("251", sendServerInfo)
+	c.HandleFunc("255", sendServerInfo)
+	c.HandleFunc("265", sendServerInfo)
+	c.HandleFunc("266", sendServerInfo)
 
-	m.irc.HandleFunc("NOTICE", func(conn *Conn, line *Line) {
+	c.HandleFunc("NOTICE", func(conn *Conn, line *Line) {
 		if len(line.Args) > 1 {
 			sender := line.Nick
 			if sender == "" && line.Src != "" {
 				sender = line.Src
 			}
-			send("NOTICE", map[string]string{
+			if line.IsCTCP() {
+				ctcp := line.CTCP()
+				send(line, "CTCP_REPLY", map[string]string{
+					"nick":    sender,
+					"command": ctcp.Command,
+					"params":  ctcp.Params,
+				})
+				return
+			}
+			send(line, "NOTICE", map[string]string{
 				"sender":  sender,
 				"message": line.Args[1],
 			})
@@ -365,24 +538,45 @@ func (m *model) setupIRCHandlers() {
 	})
 
 	// Handle IRC errors
-	sendError := func(message string) {
-		send("ERROR", map[string]string{"message": message})
+	sendError := func(line *Line, message string) {
+		send(line, "ERROR", map[string]string{"message": message})
 	}
 
-	m.irc.HandleFunc("DISCONNECTED", func(conn *Conn, line *Line) {
-		sendError("Disconnected from server")
+	// SASL results (900 RPL_LOGGEDIN, 903 RPL_SASLSUCCESS)
+	sendSASLInfo := func(conn *Conn, line *Line) {
+		if len(line.Args) > 0 {
+			send(line, "SERVER_INFO", map[string]string{"message": line.Args[len(line.Args)-1]})
+		}
+	}
+	c.HandleFunc("900", sendSASLInfo)
+	c.HandleFunc("903", sendSASLInfo)
+
+	// SASL failures (902 ERR_NICKLOCKED, 904 ERR_SASLFAIL, 905 ERR_SASLTOOLONG,
+	// 906 ERR_SASLABORTED, 907 ERR_SASLALREADY)
+	for _, code := range []string{"902", "904", "905", "906", "907"} {
+		c.HandleFunc(code, func(conn *Conn, line *Line) {
+			reason := "SASL authentication failed"
+			if len(line.Args) > 0 {
+				reason = line.Args[len(line.Args)-1]
+			}
+			sendError(line, fmt.Sprintf("SASL: %s", reason))
+		})
+	}
+
+	c.HandleFunc("DISCONNECTED", func(conn *Conn, line *Line) {
+		sendError(line, "Disconnected from server")
 	})
 
-	m.irc.HandleFunc("ERROR", func(conn *Conn, line *Line) {
+	c.HandleFunc("ERROR", func(conn *Conn, line *Line) {
 		errMsg := "Unknown error"
 		if len(line.Args) > 0 {
 			errMsg = strings.Join(line.Args, " ")
 		}
 		// Check for TLS mismatch errors
 		if strings.Contains(errMsg, "TLS") || strings.Contains(errMsg, "SSL") {
-			send("TLS_ERROR", map[string]string{"message": errMsg})
+			send(line, "TLS_ERROR", map[string]string{"message": errMsg})
 		} else {
-			sendError(errMsg)
+			sendError(line, errMsg)
 		}
 	})
 
@@ -393,7 +587,7 @@ func (m *model) setupIRCHandlers() {
 	}
 
 	// Helper to send error with optional channel context
-	sendChannelError := func(errorCode, message, channel string) {
+	sendChannelError := func(line *Line, errorCode, message, channel string) {
 		data := map[string]string{
 			"message": message,
 			"channel": channel,
@@ -402,7 +596,7 @@ func (m *model) setupIRCHandlers() {
 		if permanentErrors[errorCode] {
 			data["remove_channel"] = "true"
 		}
-		send("ERROR", data)
+		send(line, "ERROR", data)
 	}
 
 	// Handle common IRC error codes with descriptive messages
@@ -410,62 +604,69 @@ func (m *model) setupIRCHandlers() {
 		"401": func(conn *Conn, line *Line) { // ERR_NOSUCHNICK
 			if len(line.Args) >= 2 {
 				nick := line.Args[1]
-				sendChannelError("401", fmt.Sprintf("No such nick: %s", nick), nick)
+				sendChannelError(line, "401", fmt.Sprintf("No such nick: %s", nick), nick)
 			}
 		},
 		"403": func(conn *Conn, line *Line) { // ERR_NOSUCHCHANNEL
 			if len(line.Args) >= 2 {
 				channel := line.Args[1]
-				sendChannelError("403", fmt.Sprintf("No such channel: %s", channel), channel)
+				sendChannelError(line, "403", fmt.Sprintf("No such channel: %s", channel), channel)
 			}
 		},
 		"404": func(conn *Conn, line *Line) { // ERR_CANNOTSENDTOCHAN
 			if len(line.Args) >= 2 {
 				channel := line.Args[1]
-				sendChannelError("404", fmt.Sprintf("Cannot send to channel: %s", channel), channel)
+				sendChannelError(line, "404", fmt.Sprintf("Cannot send to channel: %s", channel), channel)
 			}
 		},
 		"415": func(conn *Conn, line *Line) { // Cannot send to channel (need NickServ)
 			if len(line.Args) >= 2 {
 				channel := line.Args[1]
 				message := strings.Join(line.Args[1:], " ")
-				sendChannelError("415", message, channel)
+				sendChannelError(line, "415", message, channel)
 			}
 		},
 		"433": func(conn *Conn, line *Line) { // ERR_NICKNAMEINUSE
 			if len(line.Args) >= 2 {
-				sendError(fmt.Sprintf("Nickname already in use: %s", line.Args[1]))
+				// During registration Conn retries with a fallback nick
+				if !conn.Registered() && !conn.Features().EqualFold(conn.Me(), line.Args[1]) {
+					send(line, "SERVER_INFO", map[string]string{
+						"message": fmt.Sprintf("Nickname %s is already in use, trying %s", line.Args[1], conn.Me()),
+					})
+					return
+				}
+				sendError(line, fmt.Sprintf("Nickname already in use: %s", line.Args[1]))
 			}
 		},
 		"451": func(conn *Conn, line *Line) { // ERR_NOTREGISTERED
 			if len(line.Args) >= 1 {
-				sendError(strings.Join(line.Args, " "))
+				sendError(line, strings.Join(line.Args, " "))
 			} else {
-				sendError("You have not registered")
+				sendError(line, "You have not registered")
 			}
 		},
 		"471": func(conn *Conn, line *Line) { // ERR_CHANNELISFULL
 			if len(line.Args) >= 2 {
 				channel := line.Args[1]
-				sendChannelError("471", fmt.Sprintf("Channel is full: %s", channel), channel)
+				sendChannelError(line, "471", fmt.Sprintf("Channel is full: %s", channel), channel)
 			}
 		},
 		"473": func(conn *Conn, line *Line) { // ERR_INVITEONLYCHAN
 			if len(line.Args) >= 2 {
 				channel := line.Args[1]
-				sendChannelError("473", fmt.Sprintf("Channel is invite-only: %s", channel), channel)
+				sendChannelError(line, "473", fmt.Sprintf("Channel is invite-only: %s", channel), channel)
 			}
 		},
 		"474": func(conn *Conn, line *Line) { // ERR_BANNEDFROMCHAN
 			if len(line.Args) >= 2 {
 				channel := line.Args[1]
-				sendChannelError("474", fmt.Sprintf("Banned from channel: %s", channel), channel)
+				sendChannelError(line, "474", fmt.Sprintf("Banned from channel: %s", channel), channel)
 			}
 		},
 		"475": func(conn *Conn, line *Line) { // ERR_BADCHANNELKEY
 			if len(line.Args) >= 2 {
 				channel := line.Args[1]
-				sendChannelError("475", fmt.Sprintf("Bad channel key: %s", channel), channel)
+				sendChannelError(line, "475", fmt.Sprintf("Bad channel key: %s", channel), channel)
 			}
 		},
 	}
@@ -473,16 +674,16 @@ func (m *model) setupIRCHandlers() {
 	// Generic errors that just forward the message (without channel context)
 	genericErrorCodes := []string{"477", "489", "520"}
 	for _, code := range genericErrorCodes {
-		m.irc.HandleFunc(code, func(conn *Conn, line *Line) {
+		c.HandleFunc(code, func(conn *Conn, line *Line) {
 			if len(line.Args) >= 2 {
-				sendError(strings.Join(line.Args[1:], " "))
+				sendError(line, strings.Join(line.Args[1:], " "))
 			}
 		})
 	}
 
 	// Register all error handlers
 	for code, handler := range errorHandlers {
-		m.irc.HandleFunc(code, handler)
+		c.HandleFunc(code, handler)
 	}
 }
 
@@ -498,55 +699,31 @@ func waitForIRCMessage(msgChan chan ircMessage) tea.Cmd {
 	}
 }
 
-func connectIRC(ircConn *Conn) tea.Cmd {
+func connectIRC(sup *Supervisor) tea.Cmd {
 	return func() tea.Msg {
-		if err := ircConn.Connect(); err != nil {
-			return ircMessage{
-				Type:      "ERROR",
-				Timestamp: time.Now().Format("15:04"),
-				Data:      map[string]string{"message": err.Error()},
-			}
-		}
+		sup.Start()
 		return nil
 	}
 }
 
-func (m *model) reconnectWithoutTLS() tea.Cmd {
-	return func() tea.Msg {
-		// Disconnect current connection if any
-		if m.irc != nil {
-			m.irc.Quit("")
-		}
-
-		// Create new connection without TLS
-		cfg := NewConfig(m.nick)
-		cfg.SSL = false
-		cfg.Server = fmt.Sprintf("%s:%s", m.server, m.port)
-		cfg.NewNick = func(n string) string { return n + "_" }
-		cfg.SSLConfig = nil
+// ─────────────────────────── HELPERS ───────────────────────────
 
-		m.irc = Client(cfg)
-		m.useTLS = false
-		m.setupIRCHandlers()
-
-		// Connect
-		if err := m.irc.Connect(); err != nil {
-			return ircMessage{
-				Type:      "ERROR",
-				Timestamp: time.Now().Format("15:04"),
-				Data:      map[string]string{"message": err.Error()},
-			}
-		}
-		return ircMessage{
-			Type:      "RECONNECTED",
-			Timestamp: time.Now().Format("15:04"),
-			Data:      map[string]string{"message": "Reconnected without TLS"},
-		}
+// fmtTimestamp formats a message time, adding the date for lines from an
+// earlier day (e.g. bouncer playback)
+func fmtTimestamp(ts time.Time) string {
+	ts = ts.Local()
+	now := time.Now()
+	switch {
+	case ts.Year() != now.Year():
+		return ts.Format("2006-01-02 15:04")
+	case ts.YearDay() != now.YearDay():
+		return ts.Format("Jan 02 15:04")
+	default:
+		return ts.Format("15:04")
 	}
 }
 
-// ─────────────────────────── HELPERS ───────────────────────────
-func (m *model) fmtMsg(ts, channel, user, body string) string {
+func (m *model) fmtMsg(ts time.Time, channel, user, body string) string {
 	var uStyle lipgloss.Style
 	switch strings.ToLower(user) {
 	case "alice":
@@ -559,8 +736,9 @@ func (m *model) fmtMsg(ts, channel, user, body string) string {
 		uStyle = msgUser.Foreground(lipgloss.Color("#60A5FA"))
 	}
 
-	// Calculate available width: chat width - timestamp (5) - channel (~10) - spaces (3) - username (~15)
-	tsWidth := 5
+	// Calculate available width: chat width - timestamp - channel (~10) - spaces (3) - username (~15)
+	tsText := fmtTimestamp(ts)
+	tsWidth := lipgloss.Width(tsText)
 	chanWidth := 10
 	userWidth := 15
 	availableWidth := m.chat.Width - tsWidth - chanWidth - 3 - userWidth
@@ -573,7 +751,7 @@ func (m *model) fmtMsg(ts, channel, user, body string) string {
 
 	return lipgloss.JoinHorizontal(
 		lipgloss.Left,
-		msgTs.Render(ts),
+		msgTs.Render(tsText),
 		" ",
 		chanStyle.Render(channel),
 		" ",
@@ -583,37 +761,60 @@ func (m *model) fmtMsg(ts, channel, user, body string) string {
 	)
 }
 
-func (m *model) fmtSys(ts, body string) string {
-	// Calculate available width: chat width - timestamp (5) - space (1)
-	availableWidth := m.chat.Width - 6
+// fmtAction renders a CTCP ACTION (/me) as "* nick waves", in the same
+// columns as fmtMsg
+func (m *model) fmtAction(ts time.Time, channel, user, body string) string {
+	tsText := fmtTimestamp(ts)
+	chanWidth := 10
+	availableWidth := m.chat.Width - lipgloss.Width(tsText) - chanWidth - 2
 	if availableWidth < 20 {
 		availableWidth = 20
 	}
 
-	b := lipgloss.NewStyle().Foreground(accent).Width(availableWidth)
-	return lipgloss.JoinHorizontal(lipgloss.Left, msgTs.Render(ts), " ", b.Render(body))
+	chanStyle := lipgloss.NewStyle().Foreground(muted).Width(chanWidth)
+
+	return lipgloss.JoinHorizontal(
+		lipgloss.Left,
+		msgTs.Render(tsText),
+		" ",
+		chanStyle.Render(channel),
+		" ",
+		actionStyle.Width(availableWidth).Render("* "+user+" "+body),
+	)
 }
 
-func (m *model) fmtErr(ts, body string) string {
-	// Calculate available width: chat width - timestamp (5) - space (1)
-	availableWidth := m.chat.Width - 6
-	if availableWidth < 20 {
-		availableWidth = 20
+// fmtText renders a message or, if action is set, an action
+func (m *model) fmtText(ts time.Time, channel, user, body string, action bool) string {
+	if action {
+		return m.fmtAction(ts, channel, user, body)
 	}
-
-	errStyleWithWidth := errorStyle.Width(availableWidth)
-	return lipgloss.JoinHorizontal(lipgloss.Left, msgTs.Render(ts), " ", errStyleWithWidth.Render("✗ "+body))
+	return m.fmtMsg(ts, channel, user, body)
 }
 
-func (m *model) fmtDebug(ts, body string) string {
-	// Calculate available width: chat width - timestamp (5) - space (1) - [debug] (8)
-	availableWidth := m.chat.Width - 14
+// fmtLine renders a timestamp followed by a body in the given style,
+// wrapped to the remaining chat width
+func (m *model) fmtLine(ts time.Time, style lipgloss.Style, body string) string {
+	tsText := fmtTimestamp(ts)
+
+	// Calculate available width: chat width - timestamp - space (1)
+	availableWidth := m.chat.Width - lipgloss.Width(tsText) - 1
 	if availableWidth < 20 {
 		availableWidth = 20
 	}
 
-	debugStyleWithWidth := debugStyle.Width(availableWidth)
-	return lipgloss.JoinHorizontal(lipgloss.Left, msgTs.Render(ts), " ", debugStyle.Render("[debug]"), " ", debugStyleWithWidth.Render(body))
+	return lipgloss.JoinHorizontal(lipgloss.Left, msgTs.Render(tsText), " ", style.Width(availableWidth).Render(body))
+}
+
+func (m *model) fmtSys(ts time.Time, body string) string {
+	return m.fmtLine(ts, lipgloss.NewStyle().Foreground(accent), body)
+}
+
+func (m *model) fmtErr(ts time.Time, body string) string {
+	return m.fmtLine(ts, errorStyle, "✗ "+body)
+}
+
+func (m *model) fmtDebug(ts time.Time, body string) string {
+	return m.fmtLine(ts, debugStyle, debugStyle.Render("[debug]")+" "+body)
 }
 
 func capFirst(s string) string {
@@ -625,6 +826,111 @@ func capFirst(s string) string {
 	return string(r)
 }
 
+// fmtBytes formats a byte count (e.g. "1.5 MB")
+func fmtBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// progressBar renders a bar width cells wide, filled to fraction (0 to 1)
+func progressBar(fraction float64, width int) string {
+	filled := int(fraction * float64(width))
+	return lipgloss.NewStyle().Foreground(accent).Render(strings.Repeat("█", filled)) +
+		lipgloss.NewStyle().Foreground(borderColor).Render(strings.Repeat("░", width-filled))
+}
+
+// fmtTransfer renders one line of the transfers panel, width cells wide
+func fmtTransfer(t DCCTransfer, width int) string {
+	arrow, peer := "↑", "to "+t.Nick
+	if t.Kind == DCCGet {
+		arrow, peer = "↓", "from "+t.Nick
+	}
+	label := truncateAndPad(fmt.Sprintf("#%d %s %s %s", t.ID, arrow, t.File, peer), 32)
+	info := fmt.Sprintf("%3.0f%% %9s / %-9s %s", t.Progress()*100, fmtBytes(t.Bytes), fmtBytes(t.Size), t.State)
+
+	barWidth := max(10, width-lipgloss.Width(label)-lipgloss.Width(info)-2)
+	line := label + " " + progressBar(t.Progress(), barWidth) + " " + info
+	if t.State == DCCFailed {
+		return errorStyle.Render(label) + line[len(label):]
+	}
+	return line
+}
+
+// describeDCC summarizes a DCC session for /dcc list
+func describeDCC(t DCCTransfer) string {
+	desc := fmt.Sprintf("#%d %s with %s: %s", t.ID, t.Kind, t.Nick, t.State)
+	if t.Kind != DCCChat {
+		desc = fmt.Sprintf("#%d %s %s with %s: %s, %s of %s", t.ID, t.Kind, t.File, t.Nick, t.State, fmtBytes(t.Bytes), fmtBytes(t.Size))
+	}
+	if t.Passive {
+		desc += " (passive)"
+	}
+	if t.Err != nil {
+		desc += " - " + t.Err.Error()
+	}
+	return desc
+}
+
+// dccEventData converts a DCC event for the IRC message channel
+func dccEventData(e DCCEvent) map[string]string {
+	t := e.Transfer
+	data := map[string]string{
+		"id":    strconv.Itoa(t.ID),
+		"kind":  t.Kind.String(),
+		"state": t.State.String(),
+		"nick":  t.Nick,
+		"file":  t.File,
+		"path":  t.Path,
+		"size":  fmtBytes(t.Size),
+	}
+	if t.Incoming {
+		data["incoming"] = "1"
+	}
+	if t.Err != nil {
+		data["error"] = t.Err.Error()
+	}
+	if e.Progress {
+		data["progress"] = "1"
+	}
+	if e.Text != "" {
+		data["text"] = e.Text
+	}
+	return data
+}
+
+// isDCCWindow reports whether a window is a DCC chat ("=nick")
+func isDCCWindow(window string) bool {
+	return strings.HasPrefix(window, "=")
+}
+
+// expandHome expands a leading ~/ to the home directory
+func expandHome(path string) string {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
+	}
+	return path
+}
+
+// defaultDownloadDir returns ~/Downloads, or the current directory if
+// the home directory is unknown
+func defaultDownloadDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "."
+	}
+	return filepath.Join(home, "Downloads")
+}
+
 // truncateString truncates a string to maxLen with ellipsis if needed
 func truncateString(s string, maxLen int) string {
 	if len(s) <= maxLen {
@@ -664,17 +970,16 @@ func (m *model) removeChannel(channel string) {
 	// Remove from channels list
 	newChannels := make([]string, 0, len(m.channels))
 	for _, ch := range m.channels {
-		if ch != channel {
+		if !m.sameName(ch, channel) {
 			newChannels = append(newChannels, ch)
 		}
 	}
 	m.channels = newChannels
 
-	// Remove users for this channel
-	delete(m.channelUsers, channel)
+	delete(m.channelKeys, m.fold(channel))
 
 	// If we were in this channel, switch to another or clear
-	if m.channel == channel {
+	if m.sameName(m.channel, channel) {
 		if len(m.channels) > 0 {
 			m.channel = m.channels[0]
 			m.selectedChanIdx = 0
@@ -715,11 +1020,12 @@ func (m *model) setFocus(newFocus focusArea) {
 func (m *model) updateChannelsView() {
 	var b strings.Builder
 
-	// Separate channels (start with #) from private messages (don't start with #)
+	// Separate channels (CHANTYPES prefix, e.g. #) from private messages
+	features := m.conn().Features()
 	var channels []string
 	var privateMessages []string
 	for _, ch := range m.channels {
-		if strings.HasPrefix(ch, "#") {
+		if features.IsChannel(ch) {
 			channels = append(channels, ch)
 		} else {
 			privateMessages = append(privateMessages, ch)
@@ -779,7 +1085,7 @@ func (m *model) updateChannelsView() {
 // findChannelIndex returns the index of a channel in m.channels
 func (m *model) findChannelIndex(channel string) int {
 	for i, ch := range m.channels {
-		if ch == channel {
+		if m.sameName(ch, channel) {
 			return i
 		}
 	}
@@ -791,7 +1097,7 @@ func (m *model) updateUsersView() {
 
 	// Show users for current channel
 	if m.channel != "" {
-		if users, ok := m.channelUsers[m.channel]; ok && len(users) > 0 {
+		if users := m.members(m.channel); len(users) > 0 {
 			userCount := len(users)
 			plural := "people"
 			if userCount == 1 {
@@ -800,12 +1106,17 @@ func (m *model) updateUsersView() {
 			b.WriteString(channelStyle.Render(fmt.Sprintf("%d %s here", userCount, plural)) + "\n")
 			for i, u := range users {
 				var line string
+				// Show the highest membership prefix, e.g. @ for ops
+				name := u.Nick
+				if u.Prefix != "" {
+					name = u.Prefix[:1] + name
+				}
 				if i == m.selectedUserIdx && m.currentFocus == focusUsers {
 					// Selected and focused
 					selectedStyle := lipgloss.NewStyle().Foreground(accent).Background(lipgloss.Color("235")).Bold(true)
-					line = selectedStyle.Render("► " + u)
+					line = selectedStyle.Render("► " + name)
 				} else {
-					line = "  " + userStyle.Render(u)
+					line = "  " + userStyle.Render(name)
 				}
 				b.WriteString(line + "\n")
 			}
@@ -821,7 +1132,225 @@ func (m *model) updateChat() {
 }
 
 func (m model) Init() tea.Cmd {
-	return tea.Batch(tickCmd(), connectIRC(m.irc), waitForIRCMessage(m.ircMsgChan))
+	return tea.Batch(tickCmd(), connectIRC(m.sup), waitForIRCMessage(m.ircMsgChan))
+}
+
+// sendMessage sends a PRIVMSG and shows it in the chat. With echo-message
+// the line is shown as pending until the server echoes it back; otherwise
+// it is displayed right away since the server won't echo it.
+// Long messages are split the same way the server will receive them.
+func (m *model) sendMessage(target, text string) error {
+	return m.sendText(target, text, false)
+}
+
+// sendAction sends a CTCP ACTION (/me) and shows it like sendMessage
+func (m *model) sendAction(target, text string) error {
+	return m.sendText(target, text, true)
+}
+
+func (m *model) sendText(target, text string, action bool) error {
+	ts := time.Now()
+	overhead := 0
+	if action {
+		// "\x01ACTION " + chunk + "\x01"
+		overhead = len("ACTION") + 3
+	}
+
+	for _, chunk := range m.conn().SplitMessage("PRIVMSG", target, text, overhead) {
+		var err error
+		if action {
+			err = m.conn().Action(target, chunk)
+		} else {
+			err = m.conn().Privmsg(target, chunk)
+		}
+		if err != nil {
+			return err
+		}
+
+		if !m.conn().HasCap("echo-message") {
+			m.addMessage(m.fmtText(ts, target, m.nick, chunk, action))
+			continue
+		}
+
+		rendered := m.fmtText(ts, target, m.nick, pendingStyle.Render(chunk), action)
+		m.pending = append(m.pending, pendingMessage{target: target, text: chunk, action: action, rendered: rendered})
+		m.addMessage(rendered)
+	}
+	return nil
+}
+
+// takePending removes and returns the pending message matching an echo.
+// The server may alter the text (e.g. strip formatting), so it falls back
+// to the oldest pending message for the same target.
+func (m *model) takePending(target, text string, action bool) (pendingMessage, bool) {
+	idx := -1
+	for i, p := range m.pending {
+		if m.sameName(p.target, target) {
+			if p.text == text && p.action == action {
+				idx = i
+				break
+			}
+			if idx == -1 {
+				idx = i
+			}
+		}
+	}
+	if idx == -1 {
+		return pendingMessage{}, false
+	}
+
+	p := m.pending[idx]
+	m.pending = append(m.pending[:idx], m.pending[idx+1:]...)
+	return p, true
+}
+
+// replacePending swaps a pending placeholder for its final rendering
+func (m *model) replacePending(target, text string, action bool, rendered string) bool {
+	p, ok := m.takePending(target, text, action)
+	if !ok {
+		return false
+	}
+	for i, msg := range m.messages {
+		if msg == p.rendered {
+			m.messages[i] = rendered
+			m.updateChat()
+			return true
+		}
+	}
+	// Placeholder scrolled out of the buffer; show the echo as a new line
+	return false
+}
+
+// failPending marks pending messages to a target as rejected by the server
+func (m *model) failPending(target string) {
+	for {
+		p, ok := m.takePending(target, "", false)
+		if !ok {
+			return
+		}
+		for i, msg := range m.messages {
+			if msg == p.rendered {
+				m.messages[i] = m.fmtText(time.Now(), target, m.nick, errorStyle.Render("✗ "+p.text), p.action)
+				break
+			}
+		}
+		m.updateChat()
+	}
+}
+
+// fold casefolds a nick or channel name using the server's CASEMAPPING;
+// channelKeys is keyed by folded names
+func (m *model) fold(name string) string {
+	return m.conn().Features().Fold(name)
+}
+
+// sameName reports whether two nicks or channel names are the same to
+// the server (e.g. #Go and #go)
+func (m *model) sameName(a, b string) bool {
+	return m.conn().Features().EqualFold(a, b)
+}
+
+// isMe reports whether nick is our own
+func (m *model) isMe(nick string) bool {
+	return m.sameName(nick, m.nick)
+}
+
+// hasName is contains for nicks and channel names, ignoring case the
+// way the server does
+func (m *model) hasName(names []string, name string) bool {
+	for _, n := range names {
+		if m.sameName(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// members returns the users in a channel from the connection's state
+// tracker, ops first
+func (m *model) members(channel string) []Member {
+	ch, ok := m.conn().Channel(channel)
+	if !ok {
+		return nil
+	}
+	return ch.SortedMembers(m.conn().Features())
+}
+
+// fileTransfers returns the DCC file transfers (not chats), oldest first
+func (m *model) fileTransfers() []DCCTransfer {
+	var transfers []DCCTransfer
+	for _, t := range m.dcc.Transfers() {
+		if t.Kind != DCCChat {
+			transfers = append(transfers, t)
+		}
+	}
+	return transfers
+}
+
+// transfersHeight returns the rows taken by the transfers panel
+func (m *model) transfersHeight() int {
+	if m.transferRows == 0 {
+		return 0
+	}
+	return m.transferRows + 2 // Borders
+}
+
+// dccChatID returns the active DCC chat shown in a "=nick" window
+func (m *model) dccChatID(window string) (int, bool) {
+	if !isDCCWindow(window) {
+		return 0, false
+	}
+	for _, t := range m.dcc.Transfers() {
+		if t.Kind == DCCChat && t.State == DCCActive && m.sameName(t.Nick, window[1:]) {
+			return t.ID, true
+		}
+	}
+	return 0, false
+}
+
+// findDCCOffer resolves "/dcc get" and "/dcc chat" arguments: a session
+// ID, or the latest pending offer of that kind from a nick
+func (m *model) findDCCOffer(arg string, kind DCCKind) (int, error) {
+	if id, err := strconv.Atoi(strings.TrimPrefix(arg, "#")); err == nil {
+		return id, nil
+	}
+	transfers := m.dcc.Transfers()
+	for i := len(transfers) - 1; i >= 0; i-- {
+		t := transfers[i]
+		if t.Kind == kind && t.Incoming && t.State == DCCOffered && m.sameName(t.Nick, arg) {
+			return t.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("no DCC %s offer from %s", kind, arg)
+}
+
+// sayDCC sends a line (or a /me action) to the DCC chat shown in window
+func (m *model) sayDCC(window, text string, action bool) error {
+	id, ok := m.dccChatID(window)
+	if !ok {
+		return fmt.Errorf("DCC chat with %s is not connected", window[1:])
+	}
+
+	line := text
+	if action {
+		line = "\x01ACTION " + text + "\x01"
+	}
+	if err := m.dcc.Say(id, line); err != nil {
+		return err
+	}
+	m.addMessage(m.fmtText(time.Now(), window, m.nick, text, action))
+	return nil
+}
+
+// withoutName returns names without any entry equal to name
+func (m *model) withoutName(names []string, name string) []string {
+	kept := []string{}
+	for _, n := range names {
+		if !m.sameName(n, name) {
+			kept = append(kept, n)
+		}
+	}
+	return kept
 }
 
 func contains(slice []string, item string) bool {
@@ -844,13 +1373,13 @@ func (m *model) addMessage(msg string) {
 
 func (m *model) handleIRCMessage(msg ircMessage) {
 	// Use timestamp from message if present, otherwise use current time
-	if msg.Timestamp == "" {
-		msg.Timestamp = time.Now().Format("15:04")
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
 	}
 
 	// Dispatch to handler
 	if handler, ok := m.ircEventHandlers[msg.Type]; ok {
-		handler(m, msg.Type, msg.Data)
+		handler(m, msg.Type, msg.Timestamp, msg.Data)
 	}
 }
 
@@ -865,11 +1394,11 @@ func (m *model) handleCommand(input string) {
 
 	if handler, ok := m.commandHandlers[cmd]; ok {
 		if err := handler(m, args); err != nil {
-			ts := time.Now().Format("15:04")
+			ts := time.Now()
 			m.addMessage(m.fmtErr(ts, err.Error()))
 		}
 	} else {
-		ts := time.Now().Format("15:04")
+		ts := time.Now()
 		m.addMessage(m.fmtErr(ts, fmt.Sprintf("Unknown command: %s", cmd)))
 	}
 }
@@ -880,11 +1409,12 @@ func (m *model) handleWindowResize(msg tea.WindowSizeMsg) {
 	// Account for input box (1 line + 2 borders = 3 rows) + status bar (1 row)
 	inputBoxHeight := 3
 	statusBarHeight := 1
-	availableHeight := m.height - inputBoxHeight - statusBarHeight
+	m.transferRows = min(len(m.fileTransfers()), maxTransferRows)
+	availableHeight := m.height - inputBoxHeight - statusBarHeight - m.transfersHeight()
 
 	// Check which sidebars are visible
 	hasChannelsOrMessages := len(m.channels) > 0
-	hasUsers := m.channel != "" && len(m.channelUsers[m.channel]) > 0
+	hasUsers := m.channel != "" && len(m.members(m.channel)) > 0
 
 	// Calculate total width used by sidebars
 	channelsTotalWidth := 0
@@ -930,7 +1460,7 @@ func (m *model) handleMouse(msg tea.MouseMsg) tea.Cmd {
 		// Ignore clicks in status bar and input area
 		inputBoxHeight := 3
 		statusBarHeight := 1
-		contentHeight := m.height - inputBoxHeight - statusBarHeight
+		contentHeight := m.height - inputBoxHeight - statusBarHeight - m.transfersHeight()
 
 		if y >= contentHeight {
 			// Click in input or status bar - don't change focus
@@ -983,9 +1513,7 @@ func (m *model) handleKey(msg tea.KeyMsg) tea.Cmd {
 		m.showHelp = !m.showHelp
 		return nil
 	case "ctrl+c":
-		if m.irc != nil {
-			m.irc.Quit("Goodbye!")
-		}
+		m.sup.Stop("Goodbye!")
 		return tea.Quit
 	case "tab":
 		// Cycle focus: input -> channels -> chat -> users -> input
@@ -1011,7 +1539,7 @@ func (m *model) handleKey(msg tea.KeyMsg) tea.Cmd {
 			m.updateSidebars()
 			return nil
 		} else if m.currentFocus == focusUsers && m.channel != "" {
-			if users, ok := m.channelUsers[m.channel]; ok && len(users) > 0 {
+			if users := m.members(m.channel); len(users) > 0 {
 				if m.selectedUserIdx > 0 {
 					m.selectedUserIdx--
 				}
@@ -1056,7 +1584,7 @@ func (m *model) handleKey(msg tea.KeyMsg) tea.Cmd {
 			m.updateSidebars()
 			return nil
 		} else if m.currentFocus == focusUsers && m.channel != "" {
-			if users, ok := m.channelUsers[m.channel]; ok && len(users) > 0 {
+			if users := m.members(m.channel); len(users) > 0 {
 				if m.selectedUserIdx < len(users)-1 {
 					m.selectedUserIdx++
 				}
@@ -1127,8 +1655,8 @@ func (m *model) handleKey(msg tea.KeyMsg) tea.Cmd {
 			return nil
 		} else if m.currentFocus == focusUsers && m.channel != "" {
 			// User selected from users list - populate /msg command
-			if users, ok := m.channelUsers[m.channel]; ok && len(users) > 0 && m.selectedUserIdx < len(users) {
-				selectedUser := users[m.selectedUserIdx]
+			if users := m.members(m.channel); m.selectedUserIdx < len(users) {
+				selectedUser := users[m.selectedUserIdx].Nick
 				m.input.SetValue(fmt.Sprintf("/msg %s ", selectedUser))
 				m.input.CursorEnd()
 				m.setFocus(focusInput)
@@ -1153,24 +1681,22 @@ func (m *model) handleKey(msg tea.KeyMsg) tea.Cmd {
 
 			if strings.HasPrefix(input, "/") {
 				m.handleCommand(input)
+			} else if isDCCWindow(m.channel) {
+				if err := m.sayDCC(m.channel, input, false); err != nil {
+					m.addMessage(m.fmtErr(time.Now(), err.Error()))
+				}
 			} else if m.channel != "" {
 				// Send message to channel
-				ts := time.Now().Format("15:04")
+				ts := time.Now()
 
 				// Check if IRC connection is alive
-				if m.irc == nil {
-					m.addMessage(m.fmtErr(ts, "IRC connection is nil!"))
-				} else if !m.irc.Connected() {
+				if !m.conn().Connected() {
 					m.addMessage(m.fmtErr(ts, "Not connected to IRC server!"))
-				} else {
-					// Send via IRC
-					m.irc.Privmsg(m.channel, input)
-
-					// Display locally (most IRC servers don't echo your own messages)
-					m.addMessage(m.fmtMsg(ts, m.channel, m.nick, input))
+				} else if err := m.sendMessage(m.channel, input); err != nil {
+					m.addMessage(m.fmtErr(ts, err.Error()))
 				}
 			} else {
-				m.addMessage(m.fmtErr(time.Now().Format("15:04"), "Not in a channel. Use /join <channel> first"))
+				m.addMessage(m.fmtErr(time.Now(), "Not in a channel. Use /join <channel> first"))
 			}
 			m.input.SetValue("")
 		}
@@ -1191,10 +1717,6 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		return m, tickCmd()
 
 	case ircMessage:
-		// Check if this is a reconnect request
-		if msg.Type == "RECONNECT" {
-			return m, m.reconnectWithoutTLS()
-		}
 		m.handleIRCMessage(msg)
 		return m, waitForIRCMessage(m.ircMsgChan)
 
@@ -1240,10 +1762,17 @@ func (m model) renderHelp() string {
 		"  ►             Selected channel indicator\n" +
 		"  •             Active channel indicator\n\n" +
 		helpKey.Render("Commands:") + "\n" +
-		"  /join <channel>       Join a channel\n" +
+		"  /join <channel> [key] Join a channel\n" +
 		"  /part                 Leave current channel\n" +
 		"  /msg <nick> <msg>     Send private message\n" +
+		"  /me <action>          Send an action (* nick waves)\n" +
 		"  /list                 List all channels\n" +
+		"  /ctcp <nick> <cmd>    Send a CTCP query (VERSION, PING, TIME...)\n" +
+		"  /dcc send [-passive] <nick> <file>  Offer a file\n" +
+		"  /dcc get <id|nick>    Accept a file (resumes partial downloads)\n" +
+		"  /dcc chat <nick>      Offer or accept a DCC chat\n" +
+		"  /dcc list             List DCC transfers and chats\n" +
+		"  /dcc close <id>       Cancel a transfer or close a chat\n" +
 		"  /quit                 Disconnect\n\n" +
 		helpKey.Render("Other:") + "\n" +
 		"  F1            Toggle this help\n" +
@@ -1271,7 +1800,7 @@ func (m model) View() string {
 
 	// Check if sidebars should be shown
 	hasChannelsOrMessages := len(m.channels) > 0
-	hasUsers := m.channel != "" && len(m.channelUsers[m.channel]) > 0
+	hasUsers := m.channel != "" && len(m.members(m.channel)) > 0
 
 	// Build the row components
 	var components []string
@@ -1300,9 +1829,28 @@ func (m model) View() string {
 	inputBox := inputBoxStyle.Width(m.width - 2).Render(m.input.View())
 	statusBar := m.renderStatusBar()
 
+	if m.transferRows > 0 {
+		return lipgloss.JoinVertical(lipgloss.Left, row, m.renderTransfers(), inputBox, statusBar)
+	}
 	return lipgloss.JoinVertical(lipgloss.Left, row, inputBox, statusBar)
 }
 
+// renderTransfers renders the transfers panel: the latest DCC file
+// transfers with their progress
+func (m model) renderTransfers() string {
+	transfers := m.fileTransfers()
+	if len(transfers) > m.transferRows {
+		transfers = transfers[len(transfers)-m.transferRows:]
+	}
+
+	width := m.width - 4
+	lines := make([]string, len(transfers))
+	for i, t := range transfers {
+		lines[i] = fmtTransfer(t, width)
+	}
+	return transfersBoxStyle.Width(m.width - 2).Render(strings.Join(lines, "\n"))
+}
+
 // renderSidebarBox applies border styling to sidebar content
 func (m model) renderSidebarBox(content string, height int, focused bool) string {
 	if focused {
@@ -1358,6 +1906,16 @@ func (m model) renderStatusBar() string {
 	helpText := m.getStatusHelpText()
 	clock := statusTimeStyle.Render(m.currentTime.Format("15:04"))
 
+	// Show outgoing backlog held back by flood control
+	if queued := m.conn().QueueLen(); queued > 0 {
+		clock = statusKeyStyle.Render(fmt.Sprintf("%d queued", queued)) + " • " + clock
+	}
+
+	// Show the connection state unless everything is fine
+	if m.connState != "" && m.connState != StateConnected.String() {
+		clock = errorStyle.Render(m.connState) + " • " + clock
+	}
+
 	// Calculate widths
 	availableWidth := m.width - 2
 	clockWidth := lipgloss.Width(clock)
@@ -1385,25 +1943,29 @@ func max(a, b int) int {
 
 func (m *model) registerIRCEventHandlers() {
 	// Register IRC event handlers - use shared handler for system messages
-	m.ircEventHandlers["CONNECTED"] = handleSystemMessage
+	m.ircEventHandlers["CONNECTED"] = handleConnected
 	m.ircEventHandlers["WELCOME"] = handleSystemMessage
 	m.ircEventHandlers["SERVER_INFO"] = handleSystemMessage
 	m.ircEventHandlers["LISTSTART"] = handleSystemMessage
 	m.ircEventHandlers["LISTEND"] = handleSystemMessage
-	m.ircEventHandlers["RECONNECTED"] = handleSystemMessage
 
 	m.ircEventHandlers["MOTD"] = handleMOTD
 	m.ircEventHandlers["NOTICE"] = handleNotice
+	m.ircEventHandlers["CTCP"] = handleCTCP
+	m.ircEventHandlers["CTCP_REPLY"] = handleCTCPReply
+	m.ircEventHandlers["DCC"] = handleDCC
+	m.ircEventHandlers["NICK"] = handleNick
 	m.ircEventHandlers["PRIVMSG"] = handlePrivmsg
 	m.ircEventHandlers["JOIN"] = handleJoin
 	m.ircEventHandlers["PART"] = handlePart
 	m.ircEventHandlers["QUIT"] = handleQuit
-	m.ircEventHandlers["NAMES"] = handleNames
+	m.ircEventHandlers["KICK"] = handleKick
+	m.ircEventHandlers["MODE"] = handleMode
 	m.ircEventHandlers["ENDOFNAMES"] = handleEndOfNames
 	m.ircEventHandlers["LIST"] = handleList
 	m.ircEventHandlers["ERROR"] = handleError
 	m.ircEventHandlers["TLS_ERROR"] = handleTLSError
-	m.ircEventHandlers["RECONNECT"] = handleReconnect
+	m.ircEventHandlers["STATE"] = handleState
 	m.ircEventHandlers["DEBUG"] = handleDebug
 }
 
@@ -1414,125 +1976,219 @@ func (m *model) setupCommandHandlers() {
 	m.commandHandlers["/quit"] = cmdQuit
 	m.commandHandlers["/list"] = cmdList
 	m.commandHandlers["/msg"] = cmdMsg
+	m.commandHandlers["/me"] = cmdMe
+	m.commandHandlers["/ctcp"] = cmdCtcp
+	m.commandHandlers["/dcc"] = cmdDcc
 }
 
-
 // handleSystemMessage handles generic system messages (CONNECTED, WELCOME, SERVER_INFO, etc.)
-func handleSystemMessage(m *model, eventType string, data map[string]string) {
-	ts := time.Now().Format("15:04")
+func handleSystemMessage(m *model, eventType string, ts time.Time, data map[string]string) {
 	m.addMessage(m.fmtSys(ts, data["message"]))
 }
 
-func handleMOTD(m *model, eventType string, data map[string]string) {
-	ts := time.Now().Format("15:04")
-	availableWidth := m.chat.Width - 6
-	if availableWidth < 20 {
-		availableWidth = 20
+// handleConnected records the nick the server registered us with, which
+// may be a fallback if ours was taken
+func handleConnected(m *model, eventType string, ts time.Time, data map[string]string) {
+	if nick := data["nick"]; nick != "" && nick != m.nick {
+		m.nick = nick
+		m.addMessage(m.fmtSys(ts, fmt.Sprintf("Registered as %s", nick)))
+	}
+	m.addMessage(m.fmtSys(ts, data["message"]))
+
+	// After a reconnect, rejoin every channel we were in; the state
+	// tracker refills the user lists from NAMES
+	features := m.conn().Features()
+	for _, ch := range m.channels {
+		if !features.IsChannel(ch) {
+			continue
+		}
+		m.conn().JoinKey(ch, m.channelKeys[m.fold(ch)])
 	}
-	motdStyle := lipgloss.NewStyle().Foreground(muted).Width(availableWidth)
-	m.addMessage(lipgloss.JoinHorizontal(lipgloss.Left, msgTs.Render(ts), " ", motdStyle.Render(data["message"])))
+	m.updateSidebars()
 }
 
-func handleNotice(m *model, eventType string, data map[string]string) {
-	ts := time.Now().Format("15:04")
+func handleNick(m *model, eventType string, ts time.Time, data map[string]string) {
+	nick := data["nick"]
+	newNick := data["newnick"]
+
+	if m.isMe(nick) {
+		m.nick = newNick
+		m.addMessage(m.fmtSys(ts, fmt.Sprintf("You are now known as %s", newNick)))
+	} else {
+		m.addMessage(m.fmtSys(ts, fmt.Sprintf("%s is now known as %s", nick, newNick)))
+	}
+	m.updateSidebars()
+}
+
+func handleMOTD(m *model, eventType string, ts time.Time, data map[string]string) {
+	motdStyle := lipgloss.NewStyle().Foreground(muted)
+	m.addMessage(m.fmtLine(ts, motdStyle, data["message"]))
+}
+
+func handleNotice(m *model, eventType string, ts time.Time, data map[string]string) {
 	sender := data["sender"]
 	message := data["message"]
-	availableWidth := m.chat.Width - 6
-	if availableWidth < 20 {
-		availableWidth = 20
+	noticeStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("#F59E0B")).Italic(true)
+	m.addMessage(m.fmtLine(ts, noticeStyle, fmt.Sprintf("[%s] %s", sender, message)))
+}
+
+// handleCTCP shows a CTCP query someone sent us (or a channel); the
+// connection has already replied to it
+func handleCTCP(m *model, eventType string, ts time.Time, data map[string]string) {
+	// Our own /ctcp queries echoed back
+	if m.isMe(data["nick"]) {
+		return
 	}
-	noticeStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("#F59E0B")).Italic(true).Width(availableWidth)
-	m.addMessage(lipgloss.JoinHorizontal(lipgloss.Left, msgTs.Render(ts), " ", noticeStyle.Render(fmt.Sprintf("[%s] %s", sender, message))))
+	m.addMessage(m.fmtSys(ts, fmt.Sprintf("CTCP %s from %s", data["command"], data["nick"])))
 }
 
-func handlePrivmsg(m *model, eventType string, data map[string]string) {
-	ts := time.Now().Format("15:04")
+// handleCTCPReply shows a CTCP reply in the window the query was sent
+// from; PING replies show the round-trip time
+func handleCTCPReply(m *model, eventType string, ts time.Time, data map[string]string) {
+	nick := data["nick"]
+	command := data["command"]
+	params := data["params"]
+
+	window, ok := m.ctcpWindows[m.fold(nick)]
+	if !ok {
+		window = m.channel
+	}
+
+	if command == "PING" {
+		if sent, err := strconv.ParseInt(params, 10, 64); err == nil {
+			params = time.Since(time.UnixMilli(sent)).Round(time.Millisecond).String()
+		}
+	}
+	m.addMessage(m.fmtMsg(ts, window, nick, fmt.Sprintf("CTCP %s reply: %s", command, params)))
+}
+
+// handleDCC shows DCC offers, chat lines and the outcome of transfers;
+// progress only needs the transfers panel redrawn
+func handleDCC(m *model, eventType string, ts time.Time, data map[string]string) {
+	nick := data["nick"]
+	window := "=" + nick
+
+	if text, ok := data["text"]; ok {
+		if ctcp := (&Line{Cmd: "PRIVMSG", Args: []string{nick, text}}).CTCP(); ctcp.Command == "ACTION" {
+			m.addMessage(m.fmtAction(ts, window, nick, ctcp.Params))
+		} else {
+			m.addMessage(m.fmtMsg(ts, window, nick, text))
+		}
+		return
+	}
+	if data["progress"] != "" {
+		return
+	}
+
+	id, kind, file := data["id"], data["kind"], data["file"]
+	incoming := data["incoming"] != ""
+
+	switch data["state"] {
+	case DCCOffered.String():
+		switch {
+		case kind == DCCChat.String() && incoming:
+			m.addMessage(m.fmtSys(ts, fmt.Sprintf("%s offers a DCC chat (/dcc chat %s)", nick, nick)))
+		case kind == DCCChat.String():
+			m.addMessage(m.fmtSys(ts, fmt.Sprintf("Offering a DCC chat to %s...", nick)))
+		case incoming:
+			m.addMessage(m.fmtSys(ts, fmt.Sprintf("%s offers %s (%s) (/dcc get %s)", nick, file, data["size"], id)))
+		default:
+			m.addMessage(m.fmtSys(ts, fmt.Sprintf("Offering %s to %s (DCC #%s)...", file, nick, id)))
+		}
+
+	case DCCActive.String():
+		if kind == DCCChat.String() {
+			if !m.hasName(m.channels, window) {
+				m.channels = append(m.channels, window)
+			}
+			m.channel = window
+			m.selectedChanIdx = m.findChannelIndex(window)
+			promptStyle := lipgloss.NewStyle().Foreground(accent)
+			m.input.Prompt = promptStyle.Render(fmt.Sprintf("[%s]", m.channel)) + " > "
+			m.addMessage(m.fmtSys(ts, fmt.Sprintf("DCC chat with %s connected", nick)))
+		}
+
+	case DCCDone.String():
+		switch kind {
+		case DCCChat.String():
+			m.addMessage(m.fmtSys(ts, fmt.Sprintf("DCC chat with %s ended", nick)))
+		case DCCGet.String():
+			m.addMessage(m.fmtSys(ts, fmt.Sprintf("Received %s from %s (saved to %s)", file, nick, data["path"])))
+		default:
+			m.addMessage(m.fmtSys(ts, fmt.Sprintf("Sent %s to %s", file, nick)))
+		}
+
+	case DCCFailed.String():
+		m.addMessage(m.fmtErr(ts, fmt.Sprintf("DCC #%s with %s failed: %s", id, nick, data["error"])))
+
+	case DCCClosed.String():
+		if kind == DCCChat.String() {
+			m.removeChannel(window)
+		}
+		m.addMessage(m.fmtSys(ts, fmt.Sprintf("DCC #%s with %s closed", id, nick)))
+	}
+	m.updateSidebars()
+}
+
+func handlePrivmsg(m *model, eventType string, ts time.Time, data map[string]string) {
 	nick := data["nick"]
 	target := data["target"]
 	message := data["message"]
 
 	var displayTarget string
 
-	if target == m.nick {
+	if m.isMe(target) {
 		// Private message TO us
 		displayTarget = nick
-		if !contains(m.channels, nick) {
+		if !m.hasName(m.channels, nick) {
 			m.channels = append(m.channels, nick)
 			m.updateSidebars()
 		}
-	} else if strings.HasPrefix(target, "#") {
+	} else if m.conn().Features().IsChannel(target) {
 		// Regular channel message
 		displayTarget = target
-		if users, ok := m.channelUsers[target]; ok {
-			if !contains(users, nick) {
-				m.channelUsers[target] = append(users, nick)
-				if target == m.channel {
-					m.updateSidebars()
-				}
-			}
-		} else {
-			m.channelUsers[target] = []string{nick}
-			if target == m.channel {
-				m.updateSidebars()
-			}
-		}
 	} else {
 		// Message we sent to someone else
 		displayTarget = target
-		if !contains(m.channels, target) {
+		if !m.hasName(m.channels, target) {
 			m.channels = append(m.channels, target)
 			m.updateSidebars()
 		}
 	}
 
-	m.addMessage(m.fmtMsg(ts, displayTarget, nick, message))
+	action := data["action"] != ""
+	rendered := m.fmtText(ts, displayTarget, nick, message, action)
+
+	// Our own message echoed back: replace the pending placeholder
+	if m.isMe(nick) && m.replacePending(target, message, action, rendered) {
+		return
+	}
+	m.addMessage(rendered)
 }
 
-func handleJoin(m *model, eventType string, data map[string]string) {
-	ts := time.Now().Format("15:04")
+func handleJoin(m *model, eventType string, ts time.Time, data map[string]string) {
 	nick := data["nick"]
 	channel := data["channel"]
 
-	if nick == m.nick {
-		m.channel = channel
-		if !contains(m.channels, channel) {
+	if m.isMe(nick) {
+		// Switch to newly joined channels; rejoins after a reconnect keep
+		// the current window
+		if !m.hasName(m.channels, channel) {
 			m.channels = append(m.channels, channel)
-		}
-		// Update input prompt
-		promptStyle := lipgloss.NewStyle().Foreground(accent)
-		m.input.Prompt = promptStyle.Render(fmt.Sprintf("[%s]", m.channel)) + " > "
-	} else {
-		// Add user to channel user list
-		if users, ok := m.channelUsers[channel]; ok {
-			if !contains(users, nick) {
-				m.channelUsers[channel] = append(users, nick)
-			}
-		} else {
-			m.channelUsers[channel] = []string{nick}
+			m.channel = channel
+			// Update input prompt
+			promptStyle := lipgloss.NewStyle().Foreground(accent)
+			m.input.Prompt = promptStyle.Render(fmt.Sprintf("[%s]", m.channel)) + " > "
 		}
 	}
 	m.updateSidebars()
 	m.addMessage(m.fmtSys(ts, fmt.Sprintf("%s joined %s", nick, channel)))
 }
 
-func handleQuit(m *model, eventType string, data map[string]string) {
-	ts := time.Now().Format("15:04")
+func handleQuit(m *model, eventType string, ts time.Time, data map[string]string) {
 	nick := data["nick"]
 	reason := data["reason"]
 
-	// Remove user from all channels
-	for channel := range m.channelUsers {
-		if users, ok := m.channelUsers[channel]; ok {
-			newUsers := []string{}
-			for _, u := range users {
-				if u != nick {
-					newUsers = append(newUsers, u)
-				}
-			}
-			m.channelUsers[channel] = newUsers
-		}
-	}
-
 	m.updateSidebars()
 
 	// Display quit message with reason in parentheses
@@ -1543,23 +2199,16 @@ func handleQuit(m *model, eventType string, data map[string]string) {
 	}
 }
 
-func handlePart(m *model, eventType string, data map[string]string) {
-	ts := time.Now().Format("15:04")
+func handlePart(m *model, eventType string, ts time.Time, data map[string]string) {
 	nick := data["nick"]
 	channel := data["channel"]
 
-	if nick == m.nick {
+	if m.isMe(nick) {
 		// Remove from channels list
-		newChannels := []string{}
-		for _, ch := range m.channels {
-			if ch != channel {
-				newChannels = append(newChannels, ch)
-			}
-		}
-		m.channels = newChannels
+		m.channels = m.withoutName(m.channels, channel)
 
 		// Clear current channel if it's the one we left
-		if m.channel == channel {
+		if m.sameName(m.channel, channel) {
 			if len(m.channels) > 0 {
 				m.channel = m.channels[0]
 				m.selectedChanIdx = 0
@@ -1571,62 +2220,45 @@ func handlePart(m *model, eventType string, data map[string]string) {
 			}
 		}
 
-		// Remove users for this channel
-		delete(m.channelUsers, channel)
-	} else {
-		// Someone else left
-		if users, ok := m.channelUsers[channel]; ok {
-			newUsers := []string{}
-			for _, u := range users {
-				if u != nick {
-					newUsers = append(newUsers, u)
-				}
-			}
-			m.channelUsers[channel] = newUsers
-		}
+		delete(m.channelKeys, m.fold(channel))
 	}
 	m.updateSidebars()
 	m.addMessage(m.fmtSys(ts, fmt.Sprintf("%s left %s", nick, channel)))
 }
 
-func handleNames(m *model, eventType string, data map[string]string) {
-	channel := data["channel"]
-	names := strings.Split(data["users"], " ")
-
-	// Append to existing list (353 can come in multiple messages)
-	if existing, ok := m.channelUsers[channel]; ok {
-		m.channelUsers[channel] = append(existing, names...)
-	} else {
-		m.channelUsers[channel] = names
-	}
-	// Don't update sidebar yet - wait for end of names (366)
+// handleEndOfNames refreshes the user list once the state tracker has
+// the channel's full NAMES reply
+func handleEndOfNames(m *model, eventType string, ts time.Time, data map[string]string) {
+	m.updateSidebars()
 }
 
-func handleEndOfNames(m *model, eventType string, data map[string]string) {
+// handleKick shows a kick; being kicked closes the channel's window
+func handleKick(m *model, eventType string, ts time.Time, data map[string]string) {
+	nick := data["nick"]
 	channel := data["channel"]
+	victim := data["victim"]
 
-	// Remove mode prefixes (@, +, etc.) and deduplicate
-	if users, ok := m.channelUsers[channel]; ok {
-		cleaned := make(map[string]bool)
-		cleanedList := []string{}
-
-		for _, user := range users {
-			// Remove IRC mode prefixes (@, +, %, ~, &)
-			cleanUser := strings.TrimLeft(user, "@+%~&")
-			if cleanUser != "" && !cleaned[cleanUser] {
-				cleaned[cleanUser] = true
-				cleanedList = append(cleanedList, cleanUser)
-			}
-		}
+	reason := ""
+	if data["reason"] != "" {
+		reason = fmt.Sprintf(" (%s)", data["reason"])
+	}
 
-		m.channelUsers[channel] = cleanedList
+	if m.isMe(victim) {
+		m.removeChannel(channel)
+		m.addMessage(m.fmtSys(ts, fmt.Sprintf("You were kicked from %s by %s%s", channel, nick, reason)))
+	} else {
+		m.addMessage(m.fmtSys(ts, fmt.Sprintf("%s was kicked from %s by %s%s", victim, channel, nick, reason)))
 	}
+	m.updateSidebars()
+}
 
+// handleMode shows a mode change; op and voice changes update the user list
+func handleMode(m *model, eventType string, ts time.Time, data map[string]string) {
+	m.addMessage(m.fmtSys(ts, fmt.Sprintf("%s sets mode %s on %s", data["nick"], data["modes"], data["target"])))
 	m.updateSidebars()
 }
 
-func handleList(m *model, eventType string, data map[string]string) {
-	ts := time.Now().Format("15:04")
+func handleList(m *model, eventType string, ts time.Time, data map[string]string) {
 	channel := data["channel"]
 	users := data["users"]
 	topic := data["topic"]
@@ -1636,7 +2268,8 @@ func handleList(m *model, eventType string, data map[string]string) {
 		chatWidth = 80
 	}
 
-	tsWidth := 5
+	tsText := fmtTimestamp(ts)
+	tsWidth := lipgloss.Width(tsText)
 	chanWidth := 20
 	userWidth := 8
 	spacing := 4
@@ -1657,7 +2290,7 @@ func handleList(m *model, eventType string, data map[string]string) {
 
 	m.addMessage(lipgloss.JoinHorizontal(
 		lipgloss.Left,
-		msgTs.Render(ts),
+		msgTs.Render(tsText),
 		" ",
 		listStyle.Render(channelPadded),
 		" ",
@@ -1667,11 +2300,15 @@ func handleList(m *model, eventType string, data map[string]string) {
 	))
 }
 
-func handleError(m *model, eventType string, data map[string]string) {
-	ts := time.Now().Format("15:04")
+func handleError(m *model, eventType string, ts time.Time, data map[string]string) {
 	message := data["message"]
 	m.addMessage(m.fmtErr(ts, message))
 
+	// The server refused a message we sent there (e.g. 404 cannot send)
+	if channel := data["channel"]; channel != "" {
+		m.failPending(channel)
+	}
+
 	// Only remove channel for errors that mean it doesn't exist or is permanently inaccessible
 	// Don't remove for temporary permission issues (like needing to register with NickServ)
 	if shouldRemove := data["remove_channel"]; shouldRemove == "true" {
@@ -1681,42 +2318,77 @@ func handleError(m *model, eventType string, data map[string]string) {
 	}
 }
 
-func handleTLSError(m *model, eventType string, data map[string]string) {
-	ts := time.Now().Format("15:04")
+func handleTLSError(m *model, eventType string, ts time.Time, data map[string]string) {
 	m.addMessage(m.fmtErr(ts, data["message"]))
+	if m.useTLS && (m.opts.saslUser != "" || m.opts.saslPassword != "" || m.opts.clientCert != nil) {
+		// Credentials must never go out in cleartext
+		m.addMessage(m.fmtErr(ts, "Not retrying without TLS because SASL or a client certificate is configured"))
+		return
+	}
 	if m.useTLS {
 		m.addMessage(m.fmtSys(ts, "Attempting to reconnect without TLS..."))
-		go func() {
-			time.Sleep(500 * time.Millisecond)
-			m.ircMsgChan <- ircMessage{
-				Type:      "RECONNECT",
-				Timestamp: time.Now().Format("15:04"),
-				Data:      make(map[string]string),
-			}
-		}()
+		m.useTLS = false
+		go m.sup.ReconnectWith("", func(cfg *Config) {
+			cfg.SSL = false
+			cfg.SSLConfig = nil
+		})
 	}
 }
 
-func handleReconnect(m *model, eventType string, data map[string]string) {
-	// Handled in Update() to trigger reconnection command
+// handleState shows supervisor state changes in the status bar, and
+// explains reconnect attempts in the chat
+func handleState(m *model, eventType string, ts time.Time, data map[string]string) {
+	state := data["state"]
+	m.connState = state
+
+	switch state {
+	case StateBackoff.String():
+		m.connState = fmt.Sprintf("reconnecting in %s (attempt %s)", data["delay"], data["attempt"])
+		msg := fmt.Sprintf("Reconnecting in %s...", data["delay"])
+		if reason := data["error"]; reason != "" {
+			msg = fmt.Sprintf("%s; reconnecting in %s...", capFirst(reason), data["delay"])
+		}
+		m.addMessage(m.fmtSys(ts, msg))
+	case StateStopped.String():
+		if reason := data["error"]; reason != "" && data["attempt"] == "0" {
+			// Stopped by an error retrying can't fix
+			m.addMessage(m.fmtErr(ts, fmt.Sprintf("Not reconnecting: %s", reason)))
+		} else if reason != "" {
+			m.addMessage(m.fmtErr(ts, fmt.Sprintf("Giving up reconnecting after %s attempts: %s", data["attempt"], reason)))
+		}
+	}
 }
 
-func handleDebug(m *model, eventType string, data map[string]string) {
-	ts := time.Now().Format("15:04")
+func handleDebug(m *model, eventType string, ts time.Time, data map[string]string) {
 	m.addMessage(m.fmtDebug(ts, data["message"]))
 }
 
-
 func cmdJoin(m *model, args []string) error {
 	if len(args) < 1 {
-		return fmt.Errorf("Usage: /join <channel>")
+		return fmt.Errorf("Usage: /join <channel> [key]")
 	}
 	channel := args[0]
-	if !strings.HasPrefix(channel, "#") {
+	if !m.conn().Features().IsChannel(channel) {
 		channel = "#" + channel
 	}
-	m.irc.Join(channel)
-	ts := time.Now().Format("15:04")
+
+	// Already joined: just switch to it
+	if i := m.findChannelIndex(channel); i != -1 {
+		m.channel = m.channels[i]
+		m.selectedChanIdx = i
+		promptStyle := lipgloss.NewStyle().Foreground(accent)
+		m.input.Prompt = promptStyle.Render(fmt.Sprintf("[%s]", m.channel)) + " > "
+		m.updateSidebars()
+		return nil
+	}
+
+	if len(args) >= 2 {
+		m.channelKeys[m.fold(channel)] = args[1]
+	}
+	if err := m.conn().JoinKey(channel, m.channelKeys[m.fold(channel)]); err != nil {
+		return err
+	}
+	ts := time.Now()
 	m.addMessage(m.fmtSys(ts, fmt.Sprintf("Joining %s...", channel)))
 	return nil
 }
@@ -1726,20 +2398,24 @@ func cmdPart(m *model, args []string) error {
 		return fmt.Errorf("Not in a channel")
 	}
 	channelToLeave := m.channel
-	m.irc.Part(channelToLeave)
-	ts := time.Now().Format("15:04")
+	if err := m.conn().Part(channelToLeave); err != nil {
+		return err
+	}
+	ts := time.Now()
 	m.addMessage(m.fmtSys(ts, fmt.Sprintf("Leaving %s...", channelToLeave)))
 	return nil
 }
 
 func cmdQuit(m *model, args []string) error {
-	m.irc.Quit("Goodbye!")
+	m.sup.Stop("Goodbye!")
 	return nil
 }
 
 func cmdList(m *model, args []string) error {
-	m.irc.Raw("LIST")
-	ts := time.Now().Format("15:04")
+	if err := m.conn().Raw("LIST"); err != nil {
+		return err
+	}
+	ts := time.Now()
 	m.addMessage(m.fmtSys(ts, "Fetching channel list..."))
 	return nil
 }
@@ -1750,19 +2426,132 @@ func cmdMsg(m *model, args []string) error {
 	}
 	target := args[0]
 	message := strings.Join(args[1:], " ")
-	m.irc.Privmsg(target, message)
 
 	// Add query window if not already in channels list
-	if !contains(m.channels, target) {
+	if !m.hasName(m.channels, target) {
 		m.channels = append(m.channels, target)
 		m.updateSidebars()
 	}
 
-	ts := time.Now().Format("15:04")
-	m.addMessage(m.fmtMsg(ts, target, m.nick, message))
+	return m.sendMessage(target, message)
+}
+
+func cmdMe(m *model, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: /me <action>")
+	}
+	if m.channel == "" {
+		return fmt.Errorf("Not in a channel")
+	}
+	if isDCCWindow(m.channel) {
+		return m.sayDCC(m.channel, strings.Join(args, " "), true)
+	}
+	return m.sendAction(m.channel, strings.Join(args, " "))
+}
+
+func cmdCtcp(m *model, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: /ctcp <nick> <command> [params]")
+	}
+	target := args[0]
+	command := strings.ToUpper(args[1])
+	params := strings.Join(args[2:], " ")
+	if command == "PING" && params == "" {
+		// Echoed back in the reply to measure the round trip
+		params = strconv.FormatInt(time.Now().UnixMilli(), 10)
+	}
+
+	if err := m.conn().CTCP(target, command, params); err != nil {
+		return err
+	}
+	m.ctcpWindows[m.fold(target)] = m.channel
+	m.addMessage(m.fmtSys(time.Now(), fmt.Sprintf("CTCP %s sent to %s", command, target)))
 	return nil
 }
 
+func cmdDcc(m *model, args []string) error {
+	usage := fmt.Errorf("usage: /dcc send [-passive] <nick> <file> | get <id|nick> | chat <nick> | list | close <id>")
+	if len(args) < 1 {
+		return usage
+	}
+	ts := time.Now()
+
+	switch strings.ToLower(args[0]) {
+	case "send":
+		args = args[1:]
+		passive := len(args) > 0 && args[0] == "-passive"
+		if passive {
+			args = args[1:]
+		}
+		if len(args) < 2 {
+			return usage
+		}
+		path := expandHome(strings.Join(args[1:], " "))
+		_, err := m.dcc.Send(args[0], path, passive)
+		return dccError(err)
+
+	case "get":
+		if len(args) < 2 {
+			return usage
+		}
+		id, err := m.findDCCOffer(args[1], DCCGet)
+		if err != nil {
+			return err
+		}
+		return dccError(m.dcc.Accept(id))
+
+	case "chat":
+		if len(args) < 2 {
+			return usage
+		}
+		// Accept their offer if there is one, otherwise make ours
+		if id, err := m.findDCCOffer(args[1], DCCChat); err == nil {
+			return m.dcc.Accept(id)
+		}
+		_, err := m.dcc.Chat(args[1])
+		return dccError(err)
+
+	case "list":
+		transfers := m.dcc.Transfers()
+		if len(transfers) == 0 {
+			m.addMessage(m.fmtSys(ts, "No DCC transfers or chats"))
+		}
+		for _, t := range transfers {
+			m.addMessage(m.fmtSys(ts, describeDCC(t)))
+		}
+		return nil
+
+	case "close":
+		if len(args) < 2 {
+			// Close the chat in the current window
+			if id, ok := m.dccChatID(m.channel); ok {
+				return m.dcc.Close(id)
+			}
+			return usage
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(args[1], "#"))
+		if err != nil {
+			return usage
+		}
+		return m.dcc.Close(id)
+	}
+	return usage
+}
+
+// isTLSPort reports whether port is one of the common IRC TLS ports,
+// which is how we decide to use TLS
+func isTLSPort(port string) bool {
+	return port == "6697" || port == "7000" || port == "7001" || port == "9999"
+}
+
+// dccError explains how to get around ErrDCCNeedsPublicIP
+func dccError(err error) error {
+	if errors.Is(err, ErrDCCNeedsPublicIP) {
+		return fmt.Errorf("%w: start with -dcc-ip <address>, or use /dcc send -passive", err)
+	}
+	return err
+}
+
 func parseServerAddress(addr string) (server, port string) {
 	addr = strings.ReplaceAll(addr, "/", ":")
 	parts := strings.Split(addr, ":")
@@ -1774,24 +2563,85 @@ func parseServerAddress(addr string) (server, port string) {
 
 func main() {
 	verbose := flag.Bool("v", false, "Enable verbose/debug mode")
+	saslUser := flag.String("sasl-user", "", "SASL account name")
+	saslPassword := flag.String("sasl-password", "", "SASL password (or set IRC_SASL_PASSWORD)")
+	saslMech := flag.String("sasl-mech", "", "Force a SASL mechanism (PLAIN, EXTERNAL, SCRAM-SHA-256, SCRAM-SHA-1)")
+	certFile := flag.String("cert", "", "TLS client certificate (PEM) for CertFP / SASL EXTERNAL")
+	keyFile := flag.String("key", "", "TLS client key (PEM); defaults to the -cert file")
+	downloadDir := flag.String("download-dir", defaultDownloadDir(), "Directory for files received over DCC")
+	proxy := flag.String("proxy", "", "Connect through a proxy (socks5://[user:pass@]host:port or http://host:port)")
+	dccIP := flag.String("dcc-ip", "", "Public address to advertise in DCC offers (required for them with -proxy)")
 	flag.Parse()
 
 	args := flag.Args()
 	if len(args) < 2 {
-		fmt.Println("Usage: ./irc-client [-v] <server/port> <nickname>")
+		fmt.Println("Usage: ./irc-client [-v] [-sasl-user <account>] [-cert <file> [-key <file>]] [-proxy <url>] <server/port> <nickname>")
 		fmt.Println("Options:")
-		fmt.Println("  -v    Enable verbose/debug mode (shows all IRC protocol messages)")
+		fmt.Println("  -v                     Enable verbose/debug mode (shows all IRC protocol messages)")
+		fmt.Println("  -sasl-user <account>   Authenticate with SASL")
+		fmt.Println("  -sasl-password <pass>  SASL password (defaults to $IRC_SASL_PASSWORD)")
+		fmt.Println("  -sasl-mech <mech>      Force a SASL mechanism (default: strongest the server offers)")
+		fmt.Println("  -cert <file>           TLS client certificate; authenticates with SASL EXTERNAL")
+		fmt.Println("  -key <file>            TLS client key (defaults to the -cert file)")
+		fmt.Println("  -download-dir <dir>    Where DCC downloads are saved (default: ~/Downloads)")
+		fmt.Println("  -proxy <url>           Connect through socks5://[user:pass@]host:port or http://host:port")
+		fmt.Println("  -dcc-ip <address>      Public address advertised in DCC offers (needed with -proxy)")
 		fmt.Println("Examples:")
 		fmt.Println("  ./irc-client irc.libera.chat/7000 myusername")
 		fmt.Println("  ./irc-client irc.libera.chat:7000 myusername")
 		fmt.Println("  ./irc-client -v irc.libera.chat/7000 myusername")
+		fmt.Println("  ./irc-client -proxy socks5://127.0.0.1:9050 irc.libera.chat/6697 myusername")
 		os.Exit(1)
 	}
 
 	server, port := parseServerAddress(args[0])
 	nick := args[1]
 
-	p := tea.NewProgram(initialModel(server, port, nick, *verbose), tea.WithAltScreen(), tea.WithMouseCellMotion())
+	opts := clientOptions{
+		verbose:      *verbose,
+		saslUser:     *saslUser,
+		saslPassword: *saslPassword,
+		saslMech:     *saslMech,
+		downloadDir:  *downloadDir,
+		proxy:        *proxy,
+	}
+	if opts.saslPassword == "" {
+		opts.saslPassword = os.Getenv("IRC_SASL_PASSWORD")
+	}
+	if opts.saslMech != "" && !contains(SASLMechanisms, strings.ToUpper(opts.saslMech)) {
+		fmt.Printf("Error: unsupported SASL mechanism %q (use %s)\n", opts.saslMech, strings.Join(SASLMechanisms, ", "))
+		os.Exit(1)
+	}
+	if *dccIP != "" {
+		if opts.dccIP = net.ParseIP(*dccIP); opts.dccIP == nil {
+			fmt.Printf("Error: invalid -dcc-ip address %q\n", *dccIP)
+			os.Exit(1)
+		}
+	}
+	if opts.proxy != "" {
+		if _, err := ProxyDialer(opts.proxy, &net.Dialer{}); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+	}
+	if *certFile != "" {
+		// The certificate is only ever presented in the TLS handshake
+		if !isTLSPort(port) {
+			fmt.Println("Error: -cert needs a TLS connection (port 6697, 7000, 7001 or 9999)")
+			os.Exit(1)
+		}
+		if *keyFile == "" {
+			*keyFile = *certFile
+		}
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			fmt.Println("Error loading client certificate:", err)
+			os.Exit(1)
+		}
+		opts.clientCert = &cert
+	}
+
+	p := tea.NewProgram(initialModel(server, port, nick, opts), tea.WithAltScreen(), tea.WithMouseCellMotion())
 	if _, err := p.Run(); err != nil {
 		fmt.Println("Error:", err)
 	}
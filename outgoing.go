@@ -0,0 +1,33 @@
+package main
+
+// UseOutgoing adds middleware that sees every line before it is sent.
+// It returns the line to send, possibly rewritten (e.g. to add tags), and
+// false to drop it. Middleware runs in the order it was added, each one
+// receiving the previous one's result, on the goroutine that sends.
+func (c *Conn) UseOutgoing(fn func(*Line) (*Line, bool)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.outgoing = append(c.outgoing, fn)
+}
+
+// applyOutgoing runs the outgoing middleware on a raw line. Without
+// middleware the line is sent exactly as given.
+func (c *Conn) applyOutgoing(cmd string) (string, bool, error) {
+	c.mu.RLock()
+	middleware := c.outgoing
+	c.mu.RUnlock()
+
+	if len(middleware) == 0 {
+		return cmd, true, nil
+	}
+
+	line := c.parseLine(cmd)
+	for _, fn := range middleware {
+		var keep bool
+		if line, keep = fn(line); !keep || line == nil {
+			return "", false, nil
+		}
+	}
+	cmd, err := line.serialize()
+	return cmd, err == nil, err
+}
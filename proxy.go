@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ContextDialer makes network connections; *net.Dialer and the proxy
+// dialers implement it
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// ProxyDialer returns a dialer that connects through the proxy at
+// rawURL, reaching the proxy itself with forward:
+//
+//	socks5://[user:pass@]host:port  SOCKS5; host names are resolved by the
+//	                                proxy (socks5h:// is accepted too)
+//	http://[user:pass@]host:port    HTTP CONNECT
+func ProxyDialer(rawURL string, forward ContextDialer) (ContextDialer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy: %w", err)
+	}
+	if u.Host == "" || u.Port() == "" {
+		return nil, fmt.Errorf("invalid proxy %q: expected scheme://host:port", rawURL)
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		return &socks5Dialer{addr: u.Host, auth: u.User, forward: forward}, nil
+	case "http":
+		return &httpProxyDialer{addr: u.Host, auth: u.User, forward: forward}, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (use socks5 or http)", u.Scheme)
+	}
+}
+
+// socks5Dialer connects through a SOCKS5 proxy (RFC 1928), with optional
+// username/password authentication (RFC 1929)
+type socks5Dialer struct {
+	addr    string
+	auth    *url.Userinfo
+	forward ContextDialer
+}
+
+// SOCKS5 reply codes (RFC 1928 section 6)
+var socks5Errors = []string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+func (d *socks5Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	if len(host) > 255 {
+		return nil, fmt.Errorf("host name too long for SOCKS5: %q", host)
+	}
+
+	conn, err := d.forward.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, fmt.Errorf("socks5 proxy: %w", err)
+	}
+	if err := withDeadline(ctx, conn, func() error { return d.handshake(conn, host, uint16(port)) }); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("socks5 proxy: %w", err)
+	}
+	return conn, nil
+}
+
+func (d *socks5Dialer) handshake(conn net.Conn, host string, port uint16) error {
+	// Offer no authentication, plus username/password if we have them
+	methods := []byte{0x00}
+	if d.auth != nil {
+		methods = []byte{0x00, 0x02}
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return fmt.Errorf("unexpected protocol version %d", reply[0])
+	}
+	switch reply[1] {
+	case 0x00:
+	case 0x02:
+		if d.auth == nil {
+			return errors.New("proxy requires a username and password")
+		}
+		if err := d.authenticate(conn); err != nil {
+			return err
+		}
+	default:
+		return errors.New("no acceptable authentication method")
+	}
+
+	// CONNECT; host names are sent as is so the proxy resolves them
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 0x01)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 0x04)
+		req = append(req, ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, port)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// Reply: version, status, reserved, then the bound address
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return err
+	}
+	if head[1] != 0x00 {
+		if int(head[1]) < len(socks5Errors) && socks5Errors[head[1]] != "" {
+			return errors.New(socks5Errors[head[1]])
+		}
+		return fmt.Errorf("connect failed with code %d", head[1])
+	}
+	var skip int
+	switch head[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0])
+	default:
+		return fmt.Errorf("unknown address type %d in reply", head[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+// authenticate performs username/password authentication (RFC 1929)
+func (d *socks5Dialer) authenticate(conn net.Conn) error {
+	user := d.auth.Username()
+	pass, _ := d.auth.Password()
+	if len(user) > 255 || len(pass) > 255 {
+		return errors.New("username or password too long")
+	}
+
+	req := []byte{0x01, byte(len(user))}
+	req = append(req, user...)
+	req = append(req, byte(len(pass)))
+	req = append(req, pass...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return errors.New("authentication failed")
+	}
+	return nil
+}
+
+// httpProxyDialer connects through an HTTP proxy with CONNECT
+type httpProxyDialer struct {
+	addr    string
+	auth    *url.Userinfo
+	forward ContextDialer
+}
+
+func (d *httpProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, fmt.Errorf("http proxy: %w", err)
+	}
+
+	var reader *bufio.Reader
+	err = withDeadline(ctx, conn, func() error {
+		req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+		if d.auth != nil {
+			pass, _ := d.auth.Password()
+			creds := base64.StdEncoding.EncodeToString([]byte(d.auth.Username() + ":" + pass))
+			req += "Proxy-Authorization: Basic " + creds + "\r\n"
+		}
+		if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+			return err
+		}
+
+		reader = bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+		}
+		return nil
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy: %w", err)
+	}
+
+	// The IRC server may have spoken already; keep what was read ahead
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn whose first reads come from a reader that
+// has already consumed part of the stream
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// withDeadline runs a proxy handshake on conn, bounded by ctx
+func withDeadline(ctx context.Context, conn net.Conn, handshake func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	// Unblock the handshake if ctx is cancelled midway
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	err := handshake()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Registration failures reported by ConnectContext, wrapped in a
+// *RegistrationError; test for them with errors.Is
+var (
+	ErrNickInUse        = errors.New("nickname is already in use")
+	ErrErroneousNick    = errors.New("erroneous nickname")
+	ErrNickCollision    = errors.New("nickname collision")
+	ErrPasswordMismatch = errors.New("password incorrect")
+	ErrBanned           = errors.New("banned from server")
+	ErrServerError      = errors.New("server closed the link")
+	ErrConnectionClosed = errors.New("connection closed during registration")
+	ErrSASLInsecure     = errors.New("no SASL mechanism can be used safely")
+	ErrSASLMechanism    = errors.New("unsupported SASL mechanism")
+	ErrSASLUnavailable  = errors.New("SASL is configured but the server doesn't offer it")
+)
+
+// isSASLError reports whether registration failed because SASL couldn't
+// be used
+func isSASLError(err error) bool {
+	return errors.Is(err, ErrSASLInsecure) || errors.Is(err, ErrSASLMechanism) || errors.Is(err, ErrSASLUnavailable)
+}
+
+// isConfigError reports whether err comes from our own configuration, so
+// trying again can't help
+func isConfigError(err error) bool {
+	return errors.Is(err, ErrSASLInsecure) || errors.Is(err, ErrSASLMechanism)
+}
+
+// RegistrationError describes why the server refused registration
+type RegistrationError struct {
+	Err     error  // One of the Err* values above
+	Code    string // Numeric or "ERROR" that caused it, if any
+	Message string // Human-readable text sent by the server
+}
+
+func (e *RegistrationError) Error() string {
+	if e.Message == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%v (%s: %s)", e.Err, e.Code, e.Message)
+}
+
+func (e *RegistrationError) Unwrap() error {
+	return e.Err
+}
+
+// registrationError builds the error for a line received before
+// RPL_WELCOME, or returns nil if it doesn't end registration
+func registrationError(line *Line) error {
+	var err error
+	switch line.Cmd {
+	case "ERROR":
+		err = ErrServerError
+	case "432": // ERR_ERRONEUSNICKNAME
+		err = ErrErroneousNick
+	case "433", "437": // ERR_NICKNAMEINUSE, ERR_UNAVAILRESOURCE
+		err = ErrNickInUse
+	case "436": // ERR_NICKCOLLISION
+		err = ErrNickCollision
+	case "464": // ERR_PASSWDMISMATCH
+		err = ErrPasswordMismatch
+	case "463", "465": // ERR_NOPERMFORHOST, ERR_YOUREBANNEDCREEP
+		err = ErrBanned
+	default:
+		return nil
+	}
+
+	var message string
+	if len(line.Args) > 0 {
+		message = line.Args[len(line.Args)-1]
+	}
+	return &RegistrationError{Err: err, Code: line.Cmd, Message: message}
+}
+
+// endRegistration reports the outcome of registration (nil on
+// RPL_WELCOME) to whoever waits for it; only the first outcome of a
+// session counts
+func (c *Conn) endRegistration(err error) {
+	c.mu.Lock()
+	result := c.regResult
+	c.regResult = nil
+	c.mu.Unlock()
+
+	if result != nil {
+		result <- err
+	}
+}
+
+// failRegistration ends registration with the error line maps to, if any
+func (c *Conn) failRegistration(line *Line) {
+	if err := registrationError(line); err != nil && !c.Registered() {
+		c.endRegistration(err)
+	}
+}
+
+// ConnectContext connects and waits until the server accepts
+// registration (RPL_WELCOME). Config.DialTimeout bounds the dial and
+// Config.RegisterTimeout the registration. If the server refuses us, the
+// connection is dropped and a *RegistrationError is returned.
+func (c *Conn) ConnectContext(ctx context.Context) error {
+	result, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	return c.awaitRegistration(ctx, result)
+}
+
+// awaitRegistration waits for the outcome of registration, disconnecting
+// on failure
+func (c *Conn) awaitRegistration(ctx context.Context, result chan error) error {
+	if c.cfg.RegisterTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.cfg.RegisterTimeout)
+		defer cancel()
+	}
+
+	var err error
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		err = fmt.Errorf("registration: %w", ctx.Err())
+	}
+
+	if err != nil {
+		c.Disconnect()
+	}
+	return err
+}
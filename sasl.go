@@ -0,0 +1,361 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// saslChunkSize is the maximum length of a single AUTHENTICATE payload
+const saslChunkSize = 400
+
+// saslMechanism implements one SASL authentication mechanism
+type saslMechanism interface {
+	// Name returns the mechanism name sent in AUTHENTICATE
+	Name() string
+	// Next returns the response to a (decoded) server challenge
+	Next(challenge []byte) ([]byte, error)
+}
+
+// saslPlain implements the PLAIN mechanism (RFC 4616)
+type saslPlain struct {
+	user     string
+	password string
+}
+
+func (s *saslPlain) Name() string { return "PLAIN" }
+
+func (s *saslPlain) Next(challenge []byte) ([]byte, error) {
+	// authzid \0 authcid \0 password, with authzid == authcid
+	return []byte(s.user + "\x00" + s.user + "\x00" + s.password), nil
+}
+
+// saslExternal implements the EXTERNAL mechanism (RFC 4422), where the
+// server authenticates using the TLS client certificate (CertFP)
+type saslExternal struct {
+	authzid string
+}
+
+func (s *saslExternal) Name() string { return "EXTERNAL" }
+
+func (s *saslExternal) Next(challenge []byte) ([]byte, error) {
+	// An empty authzid means "the identity tied to my certificate"
+	return []byte(s.authzid), nil
+}
+
+// saslScram implements SCRAM-SHA-1 and SCRAM-SHA-256 (RFC 5802, RFC 7677),
+// which proves knowledge of the password without sending it
+type saslScram struct {
+	name     string
+	hash     func() hash.Hash
+	user     string
+	password string
+
+	step            int
+	clientNonce     string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+func newSaslScram(name string, h func() hash.Hash, user, password string) *saslScram {
+	return &saslScram{name: name, hash: h, user: user, password: password}
+}
+
+func (s *saslScram) Name() string { return s.name }
+
+func (s *saslScram) Next(challenge []byte) ([]byte, error) {
+	s.step++
+	switch s.step {
+	case 1:
+		return s.clientFirst()
+	case 2:
+		return s.clientFinal(string(challenge))
+	case 3:
+		return s.verifyServerFinal(string(challenge))
+	default:
+		return nil, errors.New("scram: unexpected challenge")
+	}
+}
+
+// clientFirst builds the client-first-message
+func (s *saslScram) clientFirst() ([]byte, error) {
+	if s.clientNonce == "" {
+		nonce := make([]byte, 24)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		s.clientNonce = base64.RawStdEncoding.EncodeToString(nonce)
+	}
+	s.clientFirstBare = "n=" + scramEscape(s.user) + ",r=" + s.clientNonce
+	// "n,," = no channel binding, no authzid
+	return []byte("n,," + s.clientFirstBare), nil
+}
+
+// clientFinal answers the server-first-message with the client proof
+func (s *saslScram) clientFinal(serverFirst string) ([]byte, error) {
+	attrs := parseScramAttrs(serverFirst)
+	if e, ok := attrs["e"]; ok {
+		return nil, fmt.Errorf("scram: server error: %s", e)
+	}
+
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, s.clientNonce) || len(nonce) == len(s.clientNonce) {
+		return nil, errors.New("scram: invalid server nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		return nil, fmt.Errorf("scram: invalid salt: %w", err)
+	}
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil || iterations <= 0 {
+		return nil, errors.New("scram: invalid iteration count")
+	}
+
+	saltedPassword, err := pbkdf2.Key(s.hash, s.password, salt, iterations, s.hash().Size())
+	if err != nil {
+		return nil, err
+	}
+	clientKey := s.hmac(saltedPassword, "Client Key")
+	h := s.hash()
+	h.Write(clientKey)
+	storedKey := h.Sum(nil)
+
+	// "biws" is base64("n,,"), the GS2 header from the first message
+	clientFinalBare := "c=biws,r=" + nonce
+	authMessage := s.clientFirstBare + "," + serverFirst + "," + clientFinalBare
+
+	clientSignature := s.hmac(storedKey, authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	s.serverSignature = s.hmac(s.hmac(saltedPassword, "Server Key"), authMessage)
+
+	return []byte(clientFinalBare + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// verifyServerFinal checks the server signature so a rogue server
+// can't pretend authentication succeeded
+func (s *saslScram) verifyServerFinal(serverFinal string) ([]byte, error) {
+	attrs := parseScramAttrs(serverFinal)
+	if e, ok := attrs["e"]; ok {
+		return nil, fmt.Errorf("scram: server error: %s", e)
+	}
+	signature, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil || !hmac.Equal(signature, s.serverSignature) {
+		return nil, errors.New("scram: server signature mismatch")
+	}
+	return nil, nil
+}
+
+func (s *saslScram) hmac(key []byte, data string) []byte {
+	mac := hmac.New(s.hash, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// scramEscape encodes ',' and '=' in a SCRAM username
+func scramEscape(s string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(s)
+}
+
+// parseScramAttrs parses "k=v,k=v" SCRAM messages
+func parseScramAttrs(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, part := range strings.Split(msg, ",") {
+		if k, v, ok := strings.Cut(part, "="); ok {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
+
+// saslState tracks an in-progress SASL exchange
+type saslState struct {
+	mech   saslMechanism
+	active bool
+	buf    strings.Builder // Accumulates chunked server challenges
+}
+
+// hasClientCert returns whether a TLS client certificate is configured
+func (c *Conn) hasClientCert() bool {
+	return c.cfg.SSL && c.cfg.SSLConfig != nil && len(c.cfg.SSLConfig.Certificates) > 0
+}
+
+// wantsSASL returns whether SASL credentials are configured
+func (c *Conn) wantsSASL() bool {
+	return c.cfg.SASLUser != "" || c.hasClientCert()
+}
+
+// saslPreference lists password mechanisms from most to least preferred
+var saslPreference = []string{"SCRAM-SHA-256", "SCRAM-SHA-1", "PLAIN"}
+
+// SASLMechanisms lists the mechanisms Config.SASLMech can force
+var SASLMechanisms = []string{"EXTERNAL", "SCRAM-SHA-256", "SCRAM-SHA-1", "PLAIN"}
+
+// chooseSASLMechanism picks the mechanism to authenticate with. Config.SASLMech
+// forces one; otherwise EXTERNAL is used when a client certificate is set
+// without a password, and the strongest password mechanism advertised in
+// the server's sasl= capability value otherwise. PLAIN sends the password
+// as is, so it is only picked on its own over TLS.
+func (c *Conn) chooseSASLMechanism() (saslMechanism, error) {
+	mech := strings.ToUpper(c.cfg.SASLMech)
+	if mech == "" {
+		if c.hasClientCert() && c.cfg.SASLPassword == "" {
+			mech = "EXTERNAL"
+		} else if advertised, _ := c.CapValue("sasl"); advertised != "" {
+			offered := strings.Split(strings.ToUpper(advertised), ",")
+			for _, name := range saslPreference {
+				if contains(offered, name) {
+					mech = name
+					break
+				}
+			}
+		}
+		if (mech == "" || mech == "PLAIN") && !c.cfg.SSL {
+			return nil, &RegistrationError{
+				Err:     ErrSASLInsecure,
+				Code:    "SASL",
+				Message: "the server offers no SCRAM mechanism and the connection isn't TLS; set the mechanism to PLAIN to send the password anyway",
+			}
+		}
+	}
+
+	switch mech {
+	case "EXTERNAL":
+		return &saslExternal{authzid: c.cfg.SASLUser}, nil
+	case "SCRAM-SHA-256":
+		return newSaslScram(mech, sha256.New, c.cfg.SASLUser, c.cfg.SASLPassword), nil
+	case "SCRAM-SHA-1":
+		return newSaslScram(mech, sha1.New, c.cfg.SASLUser, c.cfg.SASLPassword), nil
+	case "PLAIN", "":
+		// Nothing advertised, over TLS
+		return &saslPlain{user: c.cfg.SASLUser, password: c.cfg.SASLPassword}, nil
+	default:
+		return nil, &RegistrationError{
+			Err:     ErrSASLMechanism,
+			Code:    "SASL",
+			Message: fmt.Sprintf("%s (supported: %s)", mech, strings.Join(SASLMechanisms, ", ")),
+		}
+	}
+}
+
+// startSASL begins authentication once the sasl capability is acknowledged.
+// If no mechanism can be used, registration fails and we quit rather than
+// end CAP negotiation and register unauthenticated.
+func (c *Conn) startSASL() {
+	mech, err := c.chooseSASLMechanism()
+	if err != nil {
+		c.abortSASL(err)
+		return
+	}
+
+	c.mu.Lock()
+	c.sasl = saslState{mech: mech, active: true}
+	c.mu.Unlock()
+
+	c.sendRaw("AUTHENTICATE " + mech.Name())
+}
+
+// abortSASL fails registration with err and leaves the server, which
+// closes the link
+func (c *Conn) abortSASL(err error) {
+	c.abortCap()
+	c.endRegistration(err)
+	c.sendRaw("QUIT :" + err.Error())
+}
+
+// handleAuthenticate answers an AUTHENTICATE challenge from the server
+func (c *Conn) handleAuthenticate(line *Line) {
+	if len(line.Args) < 1 {
+		return
+	}
+
+	c.mu.Lock()
+	if !c.sasl.active {
+		c.mu.Unlock()
+		return
+	}
+	chunk := line.Args[0]
+	if chunk != "+" {
+		c.sasl.buf.WriteString(chunk)
+	}
+	// A full-size chunk means more data follows
+	if len(chunk) == saslChunkSize {
+		c.mu.Unlock()
+		return
+	}
+	encoded := c.sasl.buf.String()
+	c.sasl.buf.Reset()
+	mech := c.sasl.mech
+	c.mu.Unlock()
+
+	challenge, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		c.sendRaw("AUTHENTICATE *")
+		return
+	}
+
+	response, err := mech.Next(challenge)
+	if err != nil {
+		c.sendRaw("AUTHENTICATE *")
+		return
+	}
+	c.sendAuthenticate(response)
+}
+
+// sendAuthenticate sends a response, split into 400-byte chunks
+func (c *Conn) sendAuthenticate(response []byte) {
+	encoded := base64.StdEncoding.EncodeToString(response)
+	for len(encoded) >= saslChunkSize {
+		c.sendRaw("AUTHENTICATE " + encoded[:saslChunkSize])
+		encoded = encoded[saslChunkSize:]
+	}
+	// An empty final chunk is sent as "+"
+	if encoded == "" {
+		encoded = "+"
+	}
+	c.sendRaw("AUTHENTICATE " + encoded)
+}
+
+// finishSASL ends the exchange (on success or failure) and lets
+// capability negotiation complete
+func (c *Conn) finishSASL() {
+	c.mu.Lock()
+	wasActive := c.sasl.active
+	c.sasl = saslState{}
+	c.mu.Unlock()
+
+	if wasActive {
+		c.maybeEndCap()
+	}
+}
+
+// redactSecrets hides credentials from debug logging
+func redactSecrets(cmd string) string {
+	if payload, ok := strings.CutPrefix(cmd, "AUTHENTICATE "); ok {
+		if payload != "+" && payload != "*" && !isSASLMechanismName(payload) {
+			return fmt.Sprintf("AUTHENTICATE <%d bytes redacted>", len(payload))
+		}
+	}
+	return cmd
+}
+
+// isSASLMechanismName reports whether s looks like a mechanism name
+// (upper-case letters, digits and dashes) rather than base64 data
+func isSASLMechanismName(s string) bool {
+	for _, r := range s {
+		if !(r >= 'A' && r <= 'Z') && !(r >= '0' && r <= '9') && r != '-' && r != '_' {
+			return false
+		}
+	}
+	return s != ""
+}
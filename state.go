@@ -0,0 +1,500 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// whoxToken tags the WHOX queries sent by the state tracker so their
+// replies can be told apart from anyone else's
+const whoxToken = "616"
+
+// Member is a user's membership in a channel
+type Member struct {
+	Nick   string
+	Modes  string // Membership modes, highest first (e.g. "ov")
+	Prefix string // Matching nick prefixes (e.g. "@+")
+}
+
+// ChannelState is a channel we're in, as seen by the state tracker
+type ChannelState struct {
+	Name      string
+	Topic     string
+	TopicBy   string            // Who set the topic, if known
+	TopicTime time.Time         // When the topic was set, if known
+	Modes     map[byte]string   // Channel modes and their parameters (list modes aren't tracked)
+	Members   map[string]Member // Keyed by casefolded nick
+}
+
+// SortedMembers returns the members ordered by their highest membership
+// mode (ops first), then by nick
+func (ch ChannelState) SortedMembers(f Features) []Member {
+	members := make([]Member, 0, len(ch.Members))
+	for _, m := range ch.Members {
+		members = append(members, m)
+	}
+	rank := func(m Member) int {
+		if m.Modes == "" {
+			return len(f.PrefixModes)
+		}
+		return strings.IndexByte(f.PrefixModes, m.Modes[0])
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if ri, rj := rank(members[i]), rank(members[j]); ri != rj {
+			return ri < rj
+		}
+		return f.Fold(members[i].Nick) < f.Fold(members[j].Nick)
+	})
+	return members
+}
+
+// UserState is a user sharing a channel with us (or ourselves)
+type UserState struct {
+	Nick     string
+	User     string
+	Host     string
+	RealName string
+	Account  string // Services account; empty if logged out or unknown
+	Away     bool
+	AwayMsg  string
+	Channels []string // Channels we share with the user
+}
+
+// Hostmask returns the user's nick!user@host (as far as it is known)
+func (u UserState) Hostmask() string {
+	return u.Nick + "!" + u.User + "@" + u.Host
+}
+
+// stateTracker holds channel and user state for a session. It is
+// guarded by Conn.mu.
+type stateTracker struct {
+	channels map[string]*ChannelState     // Keyed by casefolded name
+	users    map[string]*UserState        // Keyed by casefolded nick
+	names    map[string]map[string]Member // NAMES replies being received, per channel
+}
+
+func newStateTracker() stateTracker {
+	return stateTracker{
+		channels: make(map[string]*ChannelState),
+		users:    make(map[string]*UserState),
+		names:    make(map[string]map[string]Member),
+	}
+}
+
+// Channels returns the names of the channels we're in. State tracking
+// must be enabled with Config.TrackState.
+func (c *Conn) Channels() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	names := make([]string, 0, len(c.state.channels))
+	for _, ch := range c.state.channels {
+		names = append(names, ch.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Channel returns a snapshot of a channel we're in
+func (c *Conn) Channel(name string) (ChannelState, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	ch, ok := c.state.channels[c.features.Fold(name)]
+	if !ok {
+		return ChannelState{}, false
+	}
+	snapshot := *ch
+	snapshot.Modes = make(map[byte]string, len(ch.Modes))
+	for mode, param := range ch.Modes {
+		snapshot.Modes[mode] = param
+	}
+	snapshot.Members = make(map[string]Member, len(ch.Members))
+	for key, m := range ch.Members {
+		snapshot.Members[key] = m
+	}
+	return snapshot, true
+}
+
+// User returns a snapshot of a user sharing a channel with us
+func (c *Conn) User(nick string) (UserState, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	key := c.features.Fold(nick)
+	u, ok := c.state.users[key]
+	if !ok {
+		return UserState{}, false
+	}
+	snapshot := *u
+	snapshot.Channels = nil
+	for _, ch := range c.state.channels {
+		if _, ok := ch.Members[key]; ok {
+			snapshot.Channels = append(snapshot.Channels, ch.Name)
+		}
+	}
+	sort.Strings(snapshot.Channels)
+	return snapshot, true
+}
+
+// trackState updates channel and user state from a received line, when
+// enabled with Config.TrackState
+func (c *Conn) trackState(line *Line) {
+	if !c.cfg.TrackState {
+		return
+	}
+
+	c.mu.Lock()
+	s := &c.state
+	f := c.features
+	joined := s.update(line, f, c.nick)
+	c.mu.Unlock()
+
+	// Fetch hostmasks, accounts and away status of a channel we joined
+	if joined != "" {
+		if _, ok := f.Tokens["WHOX"]; ok {
+			c.Send(&Line{Cmd: "WHO", Args: []string{joined, "%tcuhnfar," + whoxToken}})
+		} else {
+			c.Send(&Line{Cmd: "WHO", Args: []string{joined}})
+		}
+	}
+}
+
+// update applies one line to the state. It returns the channel name when
+// we've just joined it.
+func (s *stateTracker) update(line *Line, f Features, me string) (joined string) {
+	isMe := line.Nick != "" && f.EqualFold(line.Nick, me)
+
+	switch line.Cmd {
+	case "JOIN":
+		if len(line.Args) < 1 || line.Nick == "" {
+			return ""
+		}
+		name := line.Args[0]
+		if isMe {
+			s.channels[f.Fold(name)] = &ChannelState{
+				Name:    name,
+				Modes:   make(map[byte]string),
+				Members: make(map[string]Member),
+			}
+			joined = name
+		}
+		ch := s.channels[f.Fold(name)]
+		if ch == nil {
+			return joined
+		}
+		u := s.seen(line.Src, f)
+		ch.Members[f.Fold(line.Nick)] = Member{Nick: line.Nick}
+		// extended-join: JOIN <channel> <account> :<realname>
+		if len(line.Args) >= 3 {
+			u.Account = accountName(line.Args[1])
+			u.RealName = line.Args[2]
+		}
+
+	case "PART":
+		if len(line.Args) >= 1 {
+			s.leave(line.Args[0], line.Nick, me, f)
+		}
+
+	case "KICK":
+		if len(line.Args) >= 2 {
+			s.leave(line.Args[0], line.Args[1], me, f)
+		}
+
+	case "QUIT":
+		key := f.Fold(line.Nick)
+		for _, ch := range s.channels {
+			delete(ch.Members, key)
+		}
+		delete(s.users, key)
+
+	case "NICK":
+		if len(line.Args) < 1 {
+			return ""
+		}
+		oldKey, newKey := f.Fold(line.Nick), f.Fold(line.Args[0])
+		if u, ok := s.users[oldKey]; ok {
+			delete(s.users, oldKey)
+			u.Nick = line.Args[0]
+			s.users[newKey] = u
+		}
+		for _, ch := range s.channels {
+			if m, ok := ch.Members[oldKey]; ok {
+				delete(ch.Members, oldKey)
+				m.Nick = line.Args[0]
+				ch.Members[newKey] = m
+			}
+		}
+
+	case "MODE":
+		if len(line.Args) >= 2 {
+			if ch := s.channels[f.Fold(line.Args[0])]; ch != nil {
+				ch.applyModes(line.Args[1], line.Args[2:], f)
+			}
+		}
+
+	case "324": // RPL_CHANNELMODEIS: <me> <channel> <modes> [params...]
+		if len(line.Args) >= 3 {
+			if ch := s.channels[f.Fold(line.Args[1])]; ch != nil {
+				ch.Modes = make(map[byte]string)
+				ch.applyModes(line.Args[2], line.Args[3:], f)
+			}
+		}
+
+	case "TOPIC":
+		if len(line.Args) >= 2 {
+			if ch := s.channels[f.Fold(line.Args[0])]; ch != nil {
+				ch.Topic, ch.TopicBy, ch.TopicTime = line.Args[1], line.Src, line.Time
+			}
+		}
+
+	case "331": // RPL_NOTOPIC
+		if len(line.Args) >= 2 {
+			if ch := s.channels[f.Fold(line.Args[1])]; ch != nil {
+				ch.Topic, ch.TopicBy, ch.TopicTime = "", "", time.Time{}
+			}
+		}
+
+	case "332": // RPL_TOPIC: <me> <channel> :<topic>
+		if len(line.Args) >= 3 {
+			if ch := s.channels[f.Fold(line.Args[1])]; ch != nil {
+				ch.Topic = line.Args[2]
+			}
+		}
+
+	case "333": // RPL_TOPICWHOTIME: <me> <channel> <setter> <unix time>
+		if len(line.Args) >= 4 {
+			if ch := s.channels[f.Fold(line.Args[1])]; ch != nil {
+				ch.TopicBy = line.Args[2]
+				if secs, err := strconv.ParseInt(line.Args[3], 10, 64); err == nil {
+					ch.TopicTime = time.Unix(secs, 0)
+				}
+			}
+		}
+
+	case "353": // RPL_NAMREPLY: <me> [<symbol>] <channel> :<names>
+		if len(line.Args) >= 3 {
+			key := f.Fold(line.Args[len(line.Args)-2])
+			if s.channels[key] == nil {
+				return ""
+			}
+			names := s.names[key]
+			if names == nil {
+				names = make(map[string]Member)
+				s.names[key] = names
+			}
+			for _, entry := range strings.Fields(line.Args[len(line.Args)-1]) {
+				prefix, src := f.SplitPrefix(entry)
+				// userhost-in-names sends nick!user@host
+				u := s.seen(src, f)
+				m := Member{Nick: u.Nick}
+				m.setPrefixes(prefix, f)
+				names[f.Fold(u.Nick)] = m
+			}
+		}
+
+	case "366": // RPL_ENDOFNAMES: <me> <channel> :End of /NAMES list
+		if len(line.Args) >= 2 {
+			key := f.Fold(line.Args[1])
+			if ch := s.channels[key]; ch != nil {
+				if names, ok := s.names[key]; ok {
+					ch.Members = names
+				}
+			}
+			delete(s.names, key)
+			s.prune(f, me)
+		}
+
+	case "352": // RPL_WHOREPLY: <me> <channel> <user> <host> <server> <nick> <flags> :<hops> <realname>
+		if len(line.Args) >= 8 {
+			_, realName, _ := strings.Cut(line.Args[7], " ")
+			s.whoReply(line.Args[1], line.Args[5], line.Args[2], line.Args[3], line.Args[6], "", realName, f)
+		}
+
+	case "354": // RPL_WHOSPCRPL for our WHOX query: <me> <token> <channel> <user> <host> <nick> <flags> <account> :<realname>
+		if len(line.Args) >= 9 && line.Args[1] == whoxToken {
+			s.whoReply(line.Args[2], line.Args[5], line.Args[3], line.Args[4], line.Args[6], line.Args[7], line.Args[8], f)
+		}
+
+	case "AWAY": // away-notify
+		if u := s.users[f.Fold(line.Nick)]; u != nil {
+			u.Away = len(line.Args) > 0
+			u.AwayMsg = ""
+			if u.Away {
+				u.AwayMsg = line.Args[0]
+			}
+		}
+
+	case "ACCOUNT": // account-notify
+		if u := s.users[f.Fold(line.Nick)]; u != nil && len(line.Args) >= 1 {
+			u.Account = accountName(line.Args[0])
+		}
+
+	case "CHGHOST":
+		if u := s.users[f.Fold(line.Nick)]; u != nil && len(line.Args) >= 2 {
+			u.User, u.Host = line.Args[0], line.Args[1]
+		}
+	}
+	return joined
+}
+
+// seen returns the user for a nick or nick!user@host, creating it if
+// needed and updating its user and host when known
+func (s *stateTracker) seen(src string, f Features) *UserState {
+	nick, userHost, hasUserHost := strings.Cut(src, "!")
+	key := f.Fold(nick)
+	u := s.users[key]
+	if u == nil {
+		u = &UserState{Nick: nick}
+		s.users[key] = u
+	}
+	if hasUserHost {
+		u.User, u.Host, _ = strings.Cut(userHost, "@")
+	}
+	return u
+}
+
+// leave removes nick from a channel, or the whole channel if it's us
+func (s *stateTracker) leave(channel, nick, me string, f Features) {
+	key := f.Fold(channel)
+	if f.EqualFold(nick, me) {
+		delete(s.channels, key)
+		delete(s.names, key)
+	} else if ch := s.channels[key]; ch != nil {
+		delete(ch.Members, f.Fold(nick))
+	}
+	s.prune(f, me)
+}
+
+// prune forgets users we no longer share a channel with
+func (s *stateTracker) prune(f Features, me string) {
+	for key := range s.users {
+		if key == f.Fold(me) {
+			continue
+		}
+		shared := false
+		for _, ch := range s.channels {
+			if _, ok := ch.Members[key]; ok {
+				shared = true
+				break
+			}
+		}
+		if !shared {
+			delete(s.users, key)
+		}
+	}
+}
+
+// whoReply applies a WHO/WHOX reply line
+func (s *stateTracker) whoReply(channel, nick, user, host, flags, account, realName string, f Features) {
+	u := s.seen(nick+"!"+user+"@"+host, f)
+	u.RealName = realName
+	if account != "" {
+		u.Account = accountName(account)
+	}
+	// Flags: H (here) or G (gone), optional * (IRC operator), then prefixes
+	u.Away = strings.HasPrefix(flags, "G")
+
+	if ch := s.channels[f.Fold(channel)]; ch != nil {
+		if m, ok := ch.Members[f.Fold(nick)]; ok {
+			var prefixes strings.Builder
+			for i := 0; i < len(flags); i++ {
+				if strings.IndexByte(f.Prefixes, flags[i]) != -1 {
+					prefixes.WriteByte(flags[i])
+				}
+			}
+			m.setPrefixes(prefixes.String(), f)
+			ch.Members[f.Fold(nick)] = m
+		}
+	}
+}
+
+// accountName maps the "*" (not logged in) account to ""
+func accountName(account string) string {
+	if account == "*" || account == "0" {
+		return ""
+	}
+	return account
+}
+
+// setPrefixes sets a member's modes from nick prefixes (e.g. "@+")
+func (m *Member) setPrefixes(prefixes string, f Features) {
+	var modes strings.Builder
+	for i := 0; i < len(prefixes); i++ {
+		if mode := f.PrefixMode(prefixes[i]); mode != 0 {
+			modes.WriteByte(mode)
+		}
+	}
+	m.setModes(modes.String(), f)
+}
+
+// setModes sets a member's modes, ordering them highest first and
+// updating the prefixes to match
+func (m *Member) setModes(modes string, f Features) {
+	var sortedModes, prefixes strings.Builder
+	for i := 0; i < len(f.PrefixModes); i++ {
+		if strings.IndexByte(modes, f.PrefixModes[i]) != -1 {
+			sortedModes.WriteByte(f.PrefixModes[i])
+			prefixes.WriteByte(f.ModePrefix(f.PrefixModes[i]))
+		}
+	}
+	m.Modes, m.Prefix = sortedModes.String(), prefixes.String()
+}
+
+// applyModes applies a channel MODE change such as "+ov-k nick1 nick2 key"
+func (ch *ChannelState) applyModes(modes string, params []string, f Features) {
+	adding := true
+	next := func() string {
+		if len(params) == 0 {
+			return ""
+		}
+		p := params[0]
+		params = params[1:]
+		return p
+	}
+
+	for i := 0; i < len(modes); i++ {
+		mode := modes[i]
+		switch {
+		case mode == '+':
+			adding = true
+		case mode == '-':
+			adding = false
+		case strings.IndexByte(f.PrefixModes, mode) != -1:
+			key := f.Fold(next())
+			if m, ok := ch.Members[key]; ok {
+				current := strings.ReplaceAll(m.Modes, string(mode), "")
+				if adding {
+					current += string(mode)
+				}
+				m.setModes(current, f)
+				ch.Members[key] = m
+			}
+		case strings.IndexByte(f.ChanModes[0], mode) != -1:
+			// List modes (bans, exceptions...) aren't tracked
+			next()
+		case strings.IndexByte(f.ChanModes[1], mode) != -1:
+			// Parameter both when set and unset (e.g. +k)
+			if param := next(); adding {
+				ch.Modes[mode] = param
+			} else {
+				delete(ch.Modes, mode)
+			}
+		case strings.IndexByte(f.ChanModes[2], mode) != -1:
+			// Parameter only when set (e.g. +l)
+			if adding {
+				ch.Modes[mode] = next()
+			} else {
+				delete(ch.Modes, mode)
+			}
+		default:
+			if adding {
+				ch.Modes[mode] = ""
+			} else {
+				delete(ch.Modes, mode)
+			}
+		}
+	}
+}
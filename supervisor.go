@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// SupervisorState is a stage of the connection lifecycle
+type SupervisorState int
+
+const (
+	StateConnecting  SupervisorState = iota // Dialing the server
+	StateRegistering                        // Connected, waiting for RPL_WELCOME
+	StateConnected                          // Registered
+	StateBackoff                            // Waiting before the next attempt
+	StateStopped                            // Stopped by the user or out of attempts
+)
+
+func (s SupervisorState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateRegistering:
+		return "registering"
+	case StateConnected:
+		return "connected"
+	case StateBackoff:
+		return "backing off"
+	case StateStopped:
+		return "stopped"
+	default:
+		return "unknown"
+	}
+}
+
+// StateChange describes a supervisor state transition
+type StateChange struct {
+	State   SupervisorState
+	Attempt int           // Consecutive failed attempts so far
+	Delay   time.Duration // Wait before the next attempt (StateBackoff only)
+	Err     error         // Why the last attempt ended, if known
+}
+
+// errDisconnected is reported when the server closes the connection
+var errDisconnected = errors.New("disconnected from server")
+
+// Supervisor keeps a connection alive, reconnecting with jittered
+// exponential backoff whenever it drops. It stops on errors in our own
+// settings (e.g. ErrSASLInsecure), which another attempt can't fix.
+type Supervisor struct {
+	MinBackoff  time.Duration // First retry delay
+	MaxBackoff  time.Duration // Upper bound on the retry delay
+	MaxAttempts int           // Consecutive failures before giving up (0 = never)
+
+	mu        sync.RWMutex
+	conn      *Conn
+	state     SupervisorState
+	onState   func(StateChange)
+	dropped   chan struct{} // Signalled on every DISCONNECTED from the Conn
+	stop      chan struct{}
+	wake      chan struct{} // Cuts a backoff short (Reconnect)
+	stopped   bool
+	immediate bool          // Skip the backoff for the next attempt (Reconnect)
+	update    func(*Config) // Applied to the Config before the next dial
+}
+
+// NewSupervisor creates a supervisor that keeps conn connected. The same
+// Conn is reconnected every time, so its handlers stay registered.
+func NewSupervisor(conn *Conn) *Supervisor {
+	s := &Supervisor{
+		MinBackoff: 2 * time.Second,
+		MaxBackoff: 5 * time.Minute,
+		conn:       conn,
+		state:      StateStopped,
+		dropped:    make(chan struct{}, 8),
+		stop:       make(chan struct{}),
+		wake:       make(chan struct{}, 1),
+	}
+
+	conn.HandleFunc(DISCONNECTED, func(*Conn, *Line) {
+		select {
+		case s.dropped <- struct{}{}:
+		case <-s.stop:
+		}
+	})
+	return s
+}
+
+// OnStateChange sets a callback invoked on every state transition
+func (s *Supervisor) OnStateChange(fn func(StateChange)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onState = fn
+}
+
+// Conn returns the supervised connection
+func (s *Supervisor) Conn() *Conn {
+	return s.conn
+}
+
+// State returns the current lifecycle state
+func (s *Supervisor) State() SupervisorState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.state
+}
+
+// Start runs the supervisor in the background
+func (s *Supervisor) Start() {
+	go s.run()
+}
+
+// Stop quits the current connection and stops reconnecting
+func (s *Supervisor) Stop(message string) {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	s.stopped = true
+	conn := s.conn
+	s.mu.Unlock()
+
+	close(s.stop)
+	conn.Quit(message)
+}
+
+// Reconnect drops the current connection and reconnects right away,
+// skipping any backoff in progress
+func (s *Supervisor) Reconnect(message string) {
+	s.ReconnectWith(message, nil)
+}
+
+// ReconnectWith is like Reconnect, but first applies update to the
+// connection's Config. The update runs on the supervisor goroutine
+// between attempts, so it doesn't race with the dial.
+func (s *Supervisor) ReconnectWith(message string, update func(*Config)) {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	s.immediate = true
+	if update != nil {
+		if prev := s.update; prev != nil {
+			s.update = func(cfg *Config) { prev(cfg); update(cfg) }
+		} else {
+			s.update = update
+		}
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	conn := s.conn
+	s.mu.Unlock()
+
+	conn.Quit(message)
+}
+
+// applyUpdate applies the pending ReconnectWith config change, if any
+func (s *Supervisor) applyUpdate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.update != nil {
+		s.update(s.conn.cfg)
+		s.update = nil
+	}
+}
+
+func (s *Supervisor) setState(change StateChange) {
+	s.mu.Lock()
+	s.state = change.State
+	fn := s.onState
+	s.mu.Unlock()
+
+	if fn != nil {
+		fn(change)
+	}
+}
+
+// backoff returns the delay before retry number attempt (1-based): an
+// exponentially growing cap with "equal jitter" (between half and all of it)
+func (s *Supervisor) backoff(attempt int) time.Duration {
+	d := s.MinBackoff
+	for i := 1; i < attempt && d < s.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > s.MaxBackoff {
+		d = s.MaxBackoff
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// waitDisconnected blocks until the connection drops or the supervisor
+// is stopped
+func (s *Supervisor) waitDisconnected() {
+	for {
+		select {
+		case <-s.dropped:
+			if !s.conn.Connected() {
+				return
+			}
+			// Stale event from an earlier session
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// run is the supervisor loop: connect, wait for registration, wait for
+// the connection to drop, back off, repeat
+func (s *Supervisor) run() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	attempt := 0
+
+	for {
+		// Discard events left over from the previous session
+		for len(s.dropped) > 0 {
+			<-s.dropped
+		}
+
+		s.applyUpdate()
+		s.setState(StateChange{State: StateConnecting, Attempt: attempt})
+		result, err := s.conn.connect(ctx)
+		if err == nil {
+			s.setState(StateChange{State: StateRegistering, Attempt: attempt})
+			err = s.conn.awaitRegistration(ctx, result)
+			if err == nil {
+				attempt = 0
+				s.setState(StateChange{State: StateConnected})
+				s.waitDisconnected()
+				err = errDisconnected
+			}
+		}
+
+		select {
+		case <-s.stop:
+			s.setState(StateChange{State: StateStopped})
+			return
+		default:
+		}
+
+		// Retrying with the same settings would fail the same way
+		if isConfigError(err) {
+			s.setState(StateChange{State: StateStopped, Attempt: attempt, Err: err})
+			return
+		}
+
+		s.mu.Lock()
+		immediate := s.immediate
+		s.immediate = false
+		if immediate {
+			// The wake-up is for this attempt; don't let it cut the next
+			// backoff short
+			select {
+			case <-s.wake:
+			default:
+			}
+		}
+		s.mu.Unlock()
+		if immediate {
+			continue
+		}
+
+		attempt++
+		if s.MaxAttempts > 0 && attempt > s.MaxAttempts {
+			s.setState(StateChange{State: StateStopped, Attempt: attempt - 1, Err: err})
+			return
+		}
+
+		delay := s.backoff(attempt)
+		s.setState(StateChange{State: StateBackoff, Attempt: attempt, Delay: delay, Err: err})
+		select {
+		case <-time.After(delay):
+		case <-s.wake:
+			s.mu.Lock()
+			s.immediate = false
+			s.mu.Unlock()
+		case <-s.stop:
+			s.setState(StateChange{State: StateStopped})
+			return
+		}
+	}
+}